@@ -0,0 +1,97 @@
+package cnet
+
+import (
+	"golang.org/x/sys/unix"
+	"net"
+	"strings"
+	"sync/atomic"
+)
+
+// AccessControl 按来源IP的访问控制，在accept与收到UDP包时检查，可在运行时通过Update原子替换规则
+// 匹配deny的地址总是被拒绝，allow不为空时只允许匹配allow的地址，unix socket不受限制
+type AccessControl struct {
+	rules atomic.Value // *aclRules
+}
+
+type aclRules struct {
+	allow, deny []*net.IPNet
+}
+
+// NewAccessControl allow与deny的元素为CIDR(如10.0.0.0/8)或单个IP
+func NewAccessControl(allow, deny []string) (*AccessControl, error) {
+	var a = new(AccessControl)
+	if err := a.Update(allow, deny); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Update 替换allow与deny列表，解析失败时保留原有规则
+func (a *AccessControl) Update(allow, deny []string) error {
+	var (
+		rules = new(aclRules)
+		err   error
+	)
+	if rules.allow, err = parseCIDRs(allow); err != nil {
+		return err
+	}
+	if rules.deny, err = parseCIDRs(deny); err != nil {
+		return err
+	}
+	a.rules.Store(rules)
+	return nil
+}
+
+// Allowed ip是否允许访问
+func (a *AccessControl) Allowed(ip net.IP) bool {
+	var rules, _ = a.rules.Load().(*aclRules)
+	if rules == nil {
+		return true
+	}
+	if containsIP(rules.deny, ip) {
+		return false
+	}
+	return len(rules.allow) == 0 || containsIP(rules.allow, ip)
+}
+
+// allowed 检查对端地址，未配置AccessControl或unix socket总是允许
+func (a *AccessControl) allowed(sa unix.Sockaddr) bool {
+	if a == nil {
+		return true
+	}
+	var ip = sockaddrIP(sa)
+	return ip == nil || a.Allowed(ip)
+}
+
+func parseCIDRs(list []string) ([]*net.IPNet, error) {
+	var nets = make([]*net.IPNet, 0, len(list))
+	for _, s := range list {
+		if !strings.Contains(s, "/") {
+			var ip = net.ParseIP(s)
+			if ip == nil {
+				return nil, &net.ParseError{Type: "IP address", Text: s}
+			}
+			if ip4 := ip.To4(); ip4 != nil {
+				nets = append(nets, &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)})
+			} else {
+				nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)})
+			}
+			continue
+		}
+		var _, ipNet, err = net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,220 @@
+package cnet
+
+import (
+	"github.com/cuckooemm/cnet/internal/netpoll"
+	"golang.org/x/sys/unix"
+	"net"
+	"os"
+	"runtime"
+)
+
+// Client 基于event-loop的tcp客户端，连接的生命周期回调与服务端一致
+type Client struct {
+	srv      *tcpServer
+	handler  TcpEventHandler
+	attached bool // use the loops of a running server
+}
+
+// NewClient 创建客户端并启动独立的event-loop，启动后回调OnInitComplete，Close时回调OnShutdown
+func NewClient(callback TcpEventHandler, opt TcpOption) (*Client, error) {
+	var (
+		srv = new(tcpServer)
+		pr  *netpoll.Poller
+		err error
+	)
+	if opt.MultiCore == 0 {
+		opt.MultiCore = runtime.NumCPU()
+	}
+	srv.opt = &opt
+	srv.network = "tcp"
+	srv.eventHandler = callback
+	srv.shutdown = make(chan struct{})
+	srv.done = make(chan struct{})
+	srv.subLoopGroup = newEventLoopGroup(srv.opt)
+	srv.logger = loggerOf(opt.Logger)
+	for i := 0; i < opt.MultiCore; i++ {
+		if pr, err = netpoll.CreatePoller(); err != nil {
+			srv.closeLoops()
+			return nil, err
+		}
+		srv.subLoopGroup.register(srv.newEventLoop(i, pr))
+	}
+	srv.workers = srv.newWorkerPool()
+	srv.startReactors()
+	go srv.serve()
+	if callback.OnInitComplete(srv) == Shutdown {
+		srv.signalShutdown()
+	}
+	return &Client{srv: srv, handler: callback}, nil
+}
+
+// NewClientWithServer 创建共享tcp服务event-loop的客户端，出站连接使用callback回调与服务的TcpOption，随服务关闭
+func NewClientWithServer(callback TcpEventHandler, srv Server) (*Client, error) {
+	var s, ok = srv.(*tcpServer)
+	if !ok || s.network != "tcp" {
+		return nil, ErrUnSupportProtocol
+	}
+	return &Client{srv: s, handler: callback, attached: true}, nil
+}
+
+// Dial 以非阻塞方式连接addr，阻塞至连接建立(OnConnOpened回调之后)、失败或超过TcpOption.ConnectTimeout
+// 连接由event-loop建立，在回调(event-loop)中调用会阻塞event-loop，返回ErrDialInLoop，应使用DialAsync
+func (cli *Client) Dial(addr string) (Conn, error) {
+	if inLoop(nil) {
+		return nil, ErrDialInLoop
+	}
+	var (
+		result = make(chan error, 1)
+		c, err = cli.connect(addr, result)
+	)
+	if err != nil {
+		return nil, err
+	}
+	// event-loop在服务关闭完成前仍会处理连接并返回结果
+	select {
+	case err = <-result:
+	case <-cli.srv.done:
+		select {
+		case err = <-result:
+		default:
+			// event-loop退出前未执行loopConnect
+			c.loop.assigned()
+			_ = unix.Close(c.fd)
+			c.releaseTCP()
+			err = ErrServerShutdown
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// DialAsync 以非阻塞方式连接addr并立即返回，可在回调中调用
+// 连接建立后回调OnConnOpened，失败或超过TcpOption.ConnectTimeout时以错误回调OnConnClosed
+func (cli *Client) DialAsync(addr string) error {
+	var _, err = cli.connect(addr, nil)
+	return err
+}
+
+// connect 创建socket并发起连接，交给event-loop等待连接建立，dial为nil时通过回调通知结果
+func (cli *Client) connect(addr string, dial chan error) (*conn, error) {
+	var (
+		tcpAddr *net.TCPAddr
+		sa      unix.Sockaddr
+		family  int
+		fd      int
+		err     error
+	)
+	if tcpAddr, err = net.ResolveTCPAddr("tcp", addr); err != nil {
+		return nil, err
+	}
+	if ip4 := tcpAddr.IP.To4(); ip4 != nil || tcpAddr.IP == nil {
+		var sa4 = &unix.SockaddrInet4{Port: tcpAddr.Port}
+		copy(sa4.Addr[:], ip4)
+		sa, family = sa4, unix.AF_INET
+	} else {
+		var sa6 = &unix.SockaddrInet6{Port: tcpAddr.Port}
+		copy(sa6.Addr[:], tcpAddr.IP.To16())
+		if tcpAddr.Zone != "" {
+			if ifi, e := net.InterfaceByName(tcpAddr.Zone); e == nil {
+				sa6.ZoneId = uint32(ifi.Index)
+			}
+		}
+		sa, family = sa6, unix.AF_INET6
+	}
+	if fd, err = unix.Socket(family, unix.SOCK_STREAM|unix.SOCK_NONBLOCK|unix.SOCK_CLOEXEC, unix.IPPROTO_TCP); err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+	if err = unix.Connect(fd, sa); err != nil && err != unix.EINPROGRESS {
+		_ = unix.Close(fd)
+		return nil, os.NewSyscallError("connect", err)
+	}
+	var (
+		el = cli.srv.subLoopGroup.next(sa)
+		c  = newTCPConn(fd, el, sa, nil)
+	)
+	c.handler = cli.handler
+	c.connecting, c.dial = true, dial
+	if err = el.poller.Trigger(func() error {
+		defer el.assigned()
+		return el.loopConnect(c)
+	}); err != nil {
+		el.assigned()
+		_ = unix.Close(fd)
+		c.releaseTCP()
+		if err == netpoll.ErrPollerClosed {
+			err = ErrServerShutdown
+		}
+		return nil, err
+	}
+	return c, nil
+}
+
+// Close 关闭客户端的event-loop及全部连接，共享服务event-loop的客户端不做任何操作
+func (cli *Client) Close() error {
+	if cli.attached {
+		return nil
+	}
+	cli.srv.signalShutdown()
+	cli.srv.Wait()
+	return nil
+}
+
+// 注册可写事件等待连接建立
+func (el *eventTcpLoop) loopConnect(c *conn) error {
+	if err := el.poller.AddWrite(c.fd); err != nil {
+		_ = unix.Close(c.fd)
+		c.connecting = false
+		if c.dial != nil {
+			c.dial <- err
+			c.releaseTCP()
+			return nil
+		}
+		var op = c.handler.OnConnClosed(c, err)
+		c.releaseTCP()
+		if op == Shutdown {
+			return ErrServerShutdown
+		}
+		return nil
+	}
+	el.connections[c.fd] = c
+	el.stats.opened()
+	if timeout := el.srv.opt.ConnectTimeout; timeout > 0 {
+		c.dialTimer = el.timers.AfterFunc(timeout, func() error {
+			c.dialTimer = nil
+			return el.loopConnected(c, ErrConnectTimeout)
+		})
+	}
+	return nil
+}
+
+// 可写事件触发或连接超时，检查连接结果
+func (el *eventTcpLoop) loopConnected(c *conn, err error) error {
+	if err == nil {
+		var errno int
+		if errno, err = unix.GetsockoptInt(c.fd, unix.SOL_SOCKET, unix.SO_ERROR); err == nil && errno != 0 {
+			err = os.NewSyscallError("connect", unix.Errno(errno))
+		}
+	}
+	if err == nil {
+		err = el.poller.ModRead(c.fd)
+	}
+	if err != nil {
+		return el.loopCloseConn(c, err)
+	}
+	if c.dialTimer != nil {
+		el.timers.Remove(c.dialTimer)
+		c.dialTimer = nil
+	}
+	if sa, e := unix.Getsockname(c.fd); e == nil {
+		c.localAddr = netpoll.SocketAddrToTCPOrUnixAddr(sa).String()
+	}
+	var dial = c.dial
+	c.connecting, c.dial = false, nil
+	err = el.loopOpen(c)
+	if dial != nil {
+		dial <- nil
+	}
+	return err
+}
@@ -1,8 +1,10 @@
 package cnet
 
 import (
-	"github.com/cuckooemm/cnet/internal"
-	"net"
+	"context"
+	"crypto/tls"
+	"io"
+	"os"
 	"time"
 )
 
@@ -17,25 +19,74 @@ const (
 const (
 	Tcp Network = iota
 	Udp
+	Unix
+	Unixgram
 )
 
-type IEventCallback interface {
-	// tcp
+// TcpEventHandler tcp服务回调，可嵌入EventServer只实现需要的方法
+type TcpEventHandler interface {
+	// 服务启动完成时回调，返回Shutdown时关闭服务
+	OnInitComplete(srv Server) (op Operation)
+	// 服务关闭时回调
+	OnShutdown(srv Server)
 	// 链接连接时回调
 	OnConnOpened(c Conn) (out []byte, op Operation)
-	// 链接关闭时回调
+	// 链接关闭时回调，Client.DialAsync连接失败时同样回调，此时未回调OnConnOpened
 	OnConnClosed(c Conn, err error) (op Operation)
 	// 读事件触发
 	ConnHandler(c Conn) (out []byte, op Operation)
 	// 唤醒conn时触发 c.wake
 	OnWakenHandler(c Conn) (out []byte, op Operation)
-	// udp
+}
+
+// UdpEventHandler udp服务回调，可嵌入EventServer只实现需要的方法
+type UdpEventHandler interface {
+	// 服务启动完成时回调，返回Shutdown时关闭服务
+	OnInitComplete(srv Server) (op Operation)
+	// 服务关闭时回调
+	OnShutdown(srv Server)
 	// 读事件触发
 	PackHandler(pack []byte, p Pconn) (out []byte, op Operation)
 	// 发送数据错误时触发
 	SendErr(remoteAddr string, err error)
 }
 
+// IEventCallback 同时支持tcp与udp的回调，用于Cnet
+type IEventCallback interface {
+	TcpEventHandler
+	UdpEventHandler
+}
+
+// EventServer 提供全部回调的空实现
+type EventServer struct{}
+
+func (es EventServer) OnInitComplete(srv Server) (op Operation)                    { return }
+func (es EventServer) OnShutdown(srv Server)                                       {}
+func (es EventServer) OnConnOpened(c Conn) (out []byte, op Operation)              { return }
+func (es EventServer) OnConnClosed(c Conn, err error) (op Operation)               { return }
+func (es EventServer) ConnHandler(c Conn) (out []byte, op Operation)               { return }
+func (es EventServer) OnWakenHandler(c Conn) (out []byte, op Operation)            { return }
+func (es EventServer) PackHandler(pack []byte, p Pconn) (out []byte, op Operation) { return }
+func (es EventServer) SendErr(remoteAddr string, err error)                        {}
+
+// ITicker 可选实现，tcp服务启动后立即回调OnTick，之后每隔返回的delay回调一次，delay <= 0 时停止回调。
+// OnTick在第一个event-loop中执行，op为Shutdown时关闭服务
+type ITicker interface {
+	OnTick() (delay time.Duration, op Operation)
+}
+
+// IBackpressure 可选实现，待发送数据超过TcpOption.WriteBufferHighWatermark时回调OnBackpressure，
+// 回落至WriteBufferLowWatermark及以下时回调OnWritable，均在event-loop中执行
+type IBackpressure interface {
+	OnBackpressure(c Conn, pending int)
+	OnWritable(c Conn)
+}
+
+// Timer 由Conn.AfterFunc和Conn.Every创建，只能在所属event-loop中(回调内)调用Stop
+type Timer interface {
+	Stop()
+}
+
 type Conn interface {
 	// 返回用户定义数据。
 	Expand() map[string]interface{}
@@ -48,6 +99,18 @@ type Conn interface {
 	// 连接的远程对端地址
 	RemoteAddr() string
 
+	// TLSState 返回TLS连接握手协商的状态，包含ALPN与对端证书，非TLS连接返回nil
+	TLSState() *tls.ConnectionState
+
+	// ProxyHeader 返回连接的PROXY protocol头，未设置ProxyProtocol或连接没有PROXY头时返回nil
+	ProxyHeader() *ProxyHeader
+
+	// Listener 返回接受该连接的监听名称，见ListenerSpec.Name，Client.Dial的连接返回空字符串
+	Listener() string
+
+	// PeerCred 返回unix socket对端进程的凭证(SO_PEERCRED)
+	PeerCred() (Ucred, error)
+
 	// Read从入站环形缓冲区中读取所有数据，而不会移动“read”指针，不会淘汰缓冲区数据，直到调用ResetBuffer方法为止 。
 	Read() (int, []byte)
 
@@ -63,9 +126,49 @@ type Conn interface {
 	// BufferLength 返回入站环形缓冲区中可用数据的长度。
 	BufferLength() int
 
+	// ReadFrame 返回Codec解出的当前帧，仅在ConnHandler回调内有效，未设置Codec时返回nil。
+	ReadFrame() []byte
+
+	// 以下方法直接访问入站环形缓冲区，返回的切片不复制数据，仅在当前回调内有效。
+
+	// Peek 返回前n个字节，不移动“read”指针，数据跨越缓冲区末尾时返回两段，不足n时返回nil，n <= 0时返回全部数据。
+	Peek(n int) [][]byte
+
+	// Discard 丢弃最多n个字节，返回丢弃的字节数。
+	Discard(n int) int
+
+	// Next 读取n个字节，不足n时返回nil且不移动“read”指针。
+	// 数据跨越缓冲区末尾时复制到连接复用的缓冲区，返回的数据在下一次调用Next或Until前有效。
+	Next(n int) []byte
+
+	// ReadByte 读取一个字节，缓冲区为空时返回io.EOF。
+	ReadByte() (byte, error)
+
+	// Until 读取直至delim(包含delim)的数据，没有delim时返回nil且不移动“read”指针，复制规则同Next。
+	Until(delim byte) []byte
+
+	// Reader 返回入站缓冲区的io.Reader视图，读取会移动“read”指针，缓冲区为空时返回io.EOF，可用于bufio等解析器。
+	Reader() io.Reader
+
 	// AsyncWrite异步将数据写入客户端/连接，通常在单个goroutine中而不是事件循环goroutine中调用它。
+	// 设置了Codec时数据会先被编码。
 	AsyncWrite([]byte) error
 
+	// AsyncWritev异步将多个buf使用一次writev系统调用写入连接，设置了Codec时每个buf分别编码。
+	AsyncWritev([][]byte) error
+
+	// AfterFunc 在d之后于所属event-loop中执行fn，连接关闭时自动取消，只能在回调中调用。
+	AfterFunc(d time.Duration, fn func(c Conn) (out []byte, op Operation)) Timer
+
+	// Every 每隔d于所属event-loop中执行一次fn，连接关闭时自动取消，只能在回调中调用。
+	Every(d time.Duration, fn func(c Conn) (out []byte, op Operation)) Timer
+
+	// PauseRead 停止监听可读事件，不再读取数据到入站缓冲区，可在任意goroutine中调用。
+	PauseRead() error
+
+	// ResumeRead 恢复监听可读事件，可在任意goroutine中调用。
+	ResumeRead() error
+
 	// 唤醒会为此连接触发一个React事件。
 	Wake() error
 
@@ -86,6 +189,32 @@ type Pconn interface {
 	SendTo(buf []byte) error
 }
 
+type Server interface {
+	// 协议
+	Network() string
+	// 服务监听地址
+	LocalAddr() string
+	// Shutdown 停止接收新连接，在ctx结束前等待各连接的待发送数据写完，然后关闭全部连接与event-loop。
+	// 等待超时返回ctx.Err()，但服务仍会被关闭。
+	// 在回调(event-loop)中调用时异步关闭并立即返回nil，ctx仍限制等待写完的时间，可在其他goroutine中Wait等待关闭完成
+	// 在OnShutdown中调用时服务已在关闭，立即返回nil
+	Shutdown(ctx context.Context) error
+	// Wait 阻塞直至服务关闭，在回调或OnShutdown中调用时立即返回
+	Wait()
+	// Stats 返回服务运行状态快照，可使用StatsHandler以Prometheus格式输出
+	Stats() Stats
+	// Upgrade 以相同的参数启动当前可执行文件并传递监听fd，新进程使用相同地址启动服务后即继承监听。
+	// 新进程就绪后优雅关闭当前服务，ctx结束前未就绪时终止新进程并返回错误，当前服务继续运行
+	Upgrade(ctx context.Context) error
+}
+
+// Ucred unix socket对端进程凭证
+type Ucred struct {
+	Pid int32
+	Uid uint32
+	Gid uint32
+}
+
 type Cnet struct {
 	// protocol
 	Network Network
@@ -93,6 +222,8 @@ type Cnet struct {
 	Addr string
 	// reuseport
 	ReusePort bool
+	// unix socket文件权限
+	SocketPerm os.FileMode
 	// event-loop number
 	MultiCore int
 	// tco keepAlive
@@ -101,98 +232,192 @@ type Cnet struct {
 	Callback IEventCallback
 	// log
 	Logger Logger
+	// systemd socket activation传递的socket名称，存在时使用该socket而不监听Addr
+	SystemdSocket string
+	// 启动与关闭时通知systemd
+	SystemdNotify bool
 }
 
+// Listener 启动服务并阻塞，直至服务关闭或收到中断信号
 func (c *Cnet) Listener() error {
+	var (
+		srv Server
+		err error
+	)
+	if srv, err = c.Start(); err != nil {
+		return err
+	}
+	serve(srv)
+	return nil
+}
+
+// Start 启动服务后立即返回，通过返回的Server控制服务生命周期
+func (c *Cnet) Start() (Server, error) {
+	var (
+		tcpOpt = TcpOption{
+			ReusePort:     c.ReusePort,
+			MultiCore:     c.MultiCore,
+			Logger:        c.Logger,
+			TcpKeepAlive:  c.TcpKeepAlive,
+			SocketPerm:    c.SocketPerm,
+			SystemdSocket: c.SystemdSocket,
+			SystemdNotify: c.SystemdNotify,
+		}
+		udpOpt = UdpOption{
+			ReusePort:     c.ReusePort,
+			MultiCore:     c.MultiCore,
+			Logger:        c.Logger,
+			SocketPerm:    c.SocketPerm,
+			SystemdSocket: c.SystemdSocket,
+			SystemdNotify: c.SystemdNotify,
+		}
+	)
 	switch c.Network {
 	case Tcp:
-		var (
-			ln  tcpListener
-			opt = TcpOption{
-				ReusePort:    c.ReusePort,
-				MultiCore:    c.MultiCore,
-				Logger:       c.Logger,
-				TcpKeepAlive: c.TcpKeepAlive,
-			}
-			err error
-		)
-		if c.ReusePort {
-			ln.ln, err = internal.ReusePortListen("tcp", c.Addr)
-		} else {
-			ln.ln, err = net.Listen("tcp", c.Addr)
-		}
-		if err != nil {
-			return err
+		return StartTcpService(c.Callback, c.Addr, tcpOpt)
+	case Udp:
+		return StartUdpService(c.Callback, c.Addr, udpOpt)
+	case Unix:
+		return StartUnixService(c.Callback, c.Addr, tcpOpt)
+	case Unixgram:
+		return StartUnixgramService(c.Callback, c.Addr, udpOpt)
+	default:
+		return nil, ErrUnSupportProtocol
+	}
+}
+
+// TcpService 启动tcp服务并阻塞，直至服务关闭或收到中断信号
+func TcpService(callback TcpEventHandler, addr string, opt TcpOption) error {
+	return serveStarted(StartTcpService(callback, addr, opt))
+}
+
+// StartTcpService 启动tcp服务后立即返回
+func StartTcpService(callback TcpEventHandler, addr string, opt TcpOption) (Server, error) {
+	return startStreamService(callback, "tcp", addr, &opt)
+}
+
+// UnixService 启动unix stream服务并阻塞，直至服务关闭或收到中断信号
+func UnixService(callback TcpEventHandler, path string, opt TcpOption) error {
+	return serveStarted(StartUnixService(callback, path, opt))
+}
+
+// StartUnixService 启动unix stream服务后立即返回，会删除残留的socket文件
+func StartUnixService(callback TcpEventHandler, path string, opt TcpOption) (Server, error) {
+	return startStreamService(callback, "unix", path, &opt)
+}
+
+// ListenerSpec MultiService中的一个监听
+type ListenerSpec struct {
+	// 监听名称，通过Conn.Listener获取，为空时使用监听地址
+	Name string
+	// Tcp或Unix
+	Network Network
+	Addr    string
+	// 该监听的TLS配置，为nil时使用TcpOption.TLSConfig
+	TLSConfig *tls.Config
+	// 为ProxyProtocolOff时使用TcpOption.ProxyProtocol
+	ProxyProtocol ProxyProtocol
+	// systemd socket activation传递的socket名称，存在时使用该socket而不监听Addr
+	SystemdSocket string
+}
+
+// MultiService 启动监听多个地址的服务并阻塞，直至服务关闭或收到中断信号
+func MultiService(callback TcpEventHandler, specs []ListenerSpec, opt TcpOption) error {
+	return serveStarted(StartMultiService(callback, specs, opt))
+}
+
+// StartMultiService 启动监听多个地址的服务后立即返回，全部监听共享同一组event-loop
+// Server的Network与LocalAddr返回第一个监听的协议与地址
+func StartMultiService(callback TcpEventHandler, specs []ListenerSpec, opt TcpOption) (Server, error) {
+	var (
+		lns = make([]*tcpListener, 0, len(specs))
+		ln  *tcpListener
+		err error
+	)
+	if len(specs) == 0 {
+		return nil, ErrNoListener
+	}
+	for _, spec := range specs {
+		var network string
+		switch spec.Network {
+		case Tcp:
+			network = "tcp"
+		case Unix:
+			network = "unix"
+		default:
+			err = ErrUnSupportProtocol
 		}
-		if err = ln.initFd(); err != nil {
-			return err
+		if err == nil {
+			var lnOpt = opt
+			lnOpt.SystemdSocket = spec.SystemdSocket
+			ln, err = listenTcp(network, spec.Addr, &lnOpt)
 		}
-		defer ln.close()
-		return startTcpService(c.Callback, &ln, &opt)
-	case Udp:
-		var (
-			ln  udpListener
-			opt = UdpOption{
-				ReusePort: c.ReusePort,
-				MultiCore: c.MultiCore,
-				Logger:    c.Logger,
+		if err != nil {
+			for _, ln = range lns {
+				ln.close()
 			}
-			err error
-		)
-		if opt.ReusePort {
-			ln.ln, err = internal.ReusePortListenPacket("udp", c.Addr)
-		} else {
-			ln.ln, err = net.ListenPacket("udp", c.Addr)
+			return nil, err
 		}
-		if err != nil {
-			return err
+		if spec.Name != "" {
+			ln.name = spec.Name
 		}
-		if err = ln.initFd(); err != nil {
-			return err
+		if spec.TLSConfig != nil {
+			ln.tlsConfig = spec.TLSConfig
 		}
-		defer ln.close()
-		return startUpdService(c.Callback, &ln, &opt)
-	default:
-		return ErrUnSupportProtocol
+		if spec.ProxyProtocol != ProxyProtocolOff {
+			ln.proxyProtocol = spec.ProxyProtocol
+		}
+		lns = append(lns, ln)
 	}
+	return startTcpService(callback, lns, &opt)
+}
+
+// UdpService 启动udp服务并阻塞，直至服务关闭或收到中断信号
+func UdpService(callback UdpEventHandler, addr string, opt UdpOption) error {
+	return serveStarted(StartUdpService(callback, addr, opt))
+}
+
+// StartUdpService 启动udp服务后立即返回
+func StartUdpService(callback UdpEventHandler, addr string, opt UdpOption) (Server, error) {
+	return startPacketService(callback, "udp", addr, &opt)
+}
+
+// UnixgramService 启动unix datagram服务并阻塞，直至服务关闭或收到中断信号
+func UnixgramService(callback UdpEventHandler, path string, opt UdpOption) error {
+	return serveStarted(StartUnixgramService(callback, path, opt))
+}
+
+// StartUnixgramService 启动unix datagram服务后立即返回，会删除残留的socket文件
+func StartUnixgramService(callback UdpEventHandler, path string, opt UdpOption) (Server, error) {
+	return startPacketService(callback, "unixgram", path, &opt)
 }
 
-func TcpService(callback IEventCallback, addr string, opt TcpOption) error {
+func startStreamService(callback TcpEventHandler, network, addr string, opt *TcpOption) (Server, error) {
 	var (
-		ln  tcpListener
+		ln  *tcpListener
 		err error
 	)
-	if opt.ReusePort {
-		ln.ln, err = internal.ReusePortListen("tcp", addr)
-	} else {
-		ln.ln, err = net.Listen("tcp", addr)
-	}
-	if err != nil {
-		return err
+	if ln, err = listenTcp(network, addr, opt); err != nil {
+		return nil, err
 	}
-	if err = ln.initFd(); err != nil {
-		return err
-	}
-	defer ln.close()
-	return startTcpService(callback, &ln, &opt)
+	return startTcpService(callback, []*tcpListener{ln}, opt)
 }
 
-func UdpService(callback IEventCallback, addr string, opt UdpOption) error {
+func startPacketService(callback UdpEventHandler, network, addr string, opt *UdpOption) (Server, error) {
 	var (
-		ln  udpListener
+		ln  *udpListener
 		err error
 	)
-	if opt.ReusePort {
-		ln.ln, err = internal.ReusePortListenPacket("udp", addr)
-	} else {
-		ln.ln, err = net.ListenPacket("udp", addr)
+	if ln, err = listenUdp(network, addr, opt); err != nil {
+		return nil, err
 	}
+	return startUpdService(callback, ln, opt)
+}
+
+func serveStarted(srv Server, err error) error {
 	if err != nil {
 		return err
 	}
-	if err = ln.initFd(); err != nil {
-		return err
-	}
-	defer ln.close()
-	return startUpdService(callback, &ln, &opt)
+	serve(srv)
+	return nil
 }
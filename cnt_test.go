@@ -1,10 +1,34 @@
 package cnet
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/cuckooemm/cnet/internal/buf"
 )
 
 func TestCnet(t *testing.T) {
@@ -20,6 +44,378 @@ func TestCnet(t *testing.T) {
 			}
 		})
 	})
+	t.Run("timeout", func(t *testing.T) {
+		t.Run("idle", func(t *testing.T) {
+			if err := testTcpTimeout(":8000", TcpOption{MultiCore: 2, IdleTimeout: 200 * time.Millisecond}, ErrIdleTimeout); err != nil {
+				t.Error(err)
+			}
+		})
+		t.Run("read", func(t *testing.T) {
+			if err := testTcpTimeout(":8000", TcpOption{MultiCore: 2, ReadTimeout: 200 * time.Millisecond, IdleTimeout: time.Minute}, ErrReadTimeout); err != nil {
+				t.Error(err)
+			}
+		})
+	})
+	t.Run("timer", func(t *testing.T) {
+		if err := testTcpTimer(":8000", TcpOption{MultiCore: 2}); err != nil {
+			t.Error(err)
+		}
+	})
+	t.Run("codec", func(t *testing.T) {
+		t.Run("length-field", func(t *testing.T) {
+			var codec, err = NewLengthFieldBasedFrameCodec(
+				EncoderConfig{LengthFieldLength: 2},
+				DecoderConfig{LengthFieldLength: 2, InitialBytesToStrip: 2},
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = testTcpCodec(":8000", codec, []string{"abc", "de"}, []byte{0, 3, 'a', 'b', 'c', 0, 2, 'd'}, []byte{'e'}); err != nil {
+				t.Error(err)
+			}
+		})
+		t.Run("line", func(t *testing.T) {
+			if err := testTcpCodec(":8000", &LineBasedFrameCodec{}, []string{"abc", "de"}, []byte("abc\r\nd"), []byte("e\n")); err != nil {
+				t.Error(err)
+			}
+		})
+		t.Run("delimiter", func(t *testing.T) {
+			var codec, err = NewDelimiterBasedFrameCodec([]byte("$$"), 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = testTcpCodec(":8000", codec, []string{"abc", "de"}, []byte("abc$"), []byte("$de$$")); err != nil {
+				t.Error(err)
+			}
+		})
+		t.Run("fixed-length", func(t *testing.T) {
+			var codec, err = NewFixedLengthFrameCodec(3)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = testTcpCodec(":8000", codec, []string{"abc", "def"}, []byte("abcd"), []byte("ef")); err != nil {
+				t.Error(err)
+			}
+		})
+		t.Run("invalid-config", func(t *testing.T) {
+			if err := testCodecConfig(); err != nil {
+				t.Error(err)
+			}
+		})
+		t.Run("encode-copy", func(t *testing.T) {
+			if err := testCodecEncodeCopy(); err != nil {
+				t.Error(err)
+			}
+		})
+		t.Run("max-frame-length", func(t *testing.T) {
+			var codec, err = NewLengthFieldBasedFrameCodec(
+				EncoderConfig{LengthFieldLength: 4},
+				DecoderConfig{LengthFieldLength: 4, InitialBytesToStrip: 4, MaxFrameLength: 16},
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = testCodecFrameTooLong(":8000", codec, []byte{0xff, 0xff, 0xff, 0xff}); err != nil {
+				t.Error("length-field:", err)
+			}
+			if err = testCodecFrameTooLong(":8000", &LineBasedFrameCodec{MaxFrameLength: 16}, bytes.Repeat([]byte("a"), 32)); err != nil {
+				t.Error("line:", err)
+			}
+		})
+	})
+	t.Run("lifecycle", func(t *testing.T) {
+		var (
+			cb  = &lifecycleCallback{}
+			srv Server
+			err error
+		)
+		if srv, err = StartTcpService(cb, ":8000", TcpOption{MultiCore: 2}); err != nil {
+			t.Fatal(err)
+		}
+		srv.Wait()
+		if cb.init != srv || cb.shutdown != srv {
+			t.Error("OnInitComplete or OnShutdown is not called with the server")
+		}
+	})
+	t.Run("shutdown-in-callback", func(t *testing.T) {
+		t.Run("reactor", func(t *testing.T) {
+			if err := testShutdownInCallback("tcp", ":8000", TcpOption{MultiCore: 2}); err != nil {
+				t.Error(err)
+			}
+		})
+		t.Run("reuse-port", func(t *testing.T) {
+			if err := testShutdownInCallback("tcp", ":8000", TcpOption{MultiCore: 2, ReusePort: true}); err != nil {
+				t.Error(err)
+			}
+		})
+		t.Run("udp", func(t *testing.T) {
+			if err := testShutdownInCallback("udp", ":8000", TcpOption{}); err != nil {
+				t.Error(err)
+			}
+		})
+		for _, network := range []string{"tcp", "udp"} {
+			var network = network
+			t.Run("on-init-complete-"+network, func(t *testing.T) {
+				if err := testShutdownInHook(network, ":8000", true); err != nil {
+					t.Error(err)
+				}
+			})
+			t.Run("on-shutdown-"+network, func(t *testing.T) {
+				if err := testShutdownInHook(network, ":8000", false); err != nil {
+					t.Error(err)
+				}
+			})
+		}
+	})
+	t.Run("unix", func(t *testing.T) {
+		var dir, err = ioutil.TempDir("", "cnet")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		t.Run("stream", func(t *testing.T) {
+			if err := testUnixService(filepath.Join(dir, "stream.sock")); err != nil {
+				t.Error(err)
+			}
+		})
+		t.Run("datagram", func(t *testing.T) {
+			if err := testUnixgramService(filepath.Join(dir, "dgram.sock"), filepath.Join(dir, "client.sock")); err != nil {
+				t.Error(err)
+			}
+		})
+		t.Run("socket-in-use", func(t *testing.T) {
+			if err := testUnixSocketInUse(filepath.Join(dir, "live.sock")); err != nil {
+				t.Error(err)
+			}
+		})
+	})
+	t.Run("client", func(t *testing.T) {
+		t.Run("own-loops", func(t *testing.T) {
+			if err := testTcpClient(":8000", false); err != nil {
+				t.Error(err)
+			}
+		})
+		t.Run("server-loops", func(t *testing.T) {
+			if err := testTcpClient(":8000", true); err != nil {
+				t.Error(err)
+			}
+		})
+		t.Run("dial-in-callback", func(t *testing.T) {
+			if err := testDialInCallback(":8000", ":8001"); err != nil {
+				t.Error(err)
+			}
+		})
+	})
+	t.Run("writev", func(t *testing.T) {
+		if err := testTcpWritev(":8000"); err != nil {
+			t.Error(err)
+		}
+	})
+	t.Run("backpressure", func(t *testing.T) {
+		if err := testTcpBackpressure(":8000"); err != nil {
+			t.Error(err)
+		}
+	})
+	t.Run("async-write-overflow", func(t *testing.T) {
+		t.Run("drop", func(t *testing.T) {
+			if err := testAsyncWriteOverflow(":8000", OverflowDrop); err != nil {
+				t.Error(err)
+			}
+		})
+		t.Run("close", func(t *testing.T) {
+			if err := testAsyncWriteOverflow(":8000", OverflowClose); err != nil {
+				t.Error(err)
+			}
+		})
+	})
+	t.Run("pause-read", func(t *testing.T) {
+		if err := testTcpPauseRead(":8000", TcpOption{}); err != nil {
+			t.Error(err)
+		}
+	})
+	t.Run("edge-triggered", func(t *testing.T) {
+		var opt = TcpOption{MultiCore: 2, EdgeTriggered: true}
+		t.Run("base", func(t *testing.T) {
+			if err := testTcpService(":8000", opt); err != nil {
+				t.Error(err)
+			}
+		})
+		t.Run("pause-read", func(t *testing.T) {
+			if err := testTcpPauseRead(":8000", opt); err != nil {
+				t.Error(err)
+			}
+		})
+		t.Run("large-echo", func(t *testing.T) {
+			if err := testLargeEcho(":8000", opt); err != nil {
+				t.Error(err)
+			}
+		})
+		t.Run("half-close", func(t *testing.T) {
+			if err := testHalfClose(":8000", opt); err != nil {
+				t.Error(err)
+			}
+		})
+	})
+	t.Run("tls", func(t *testing.T) {
+		t.Run("single-loop", func(t *testing.T) {
+			if err := testTcpTLS(":8000", 0); err != nil {
+				t.Error(err)
+			}
+		})
+		t.Run("multiCore", func(t *testing.T) {
+			if err := testTcpTLS(":8000", 2); err != nil {
+				t.Error(err)
+			}
+		})
+		t.Run("handshake-timeout", func(t *testing.T) {
+			if err := testTLSHandshakeTimeout(":8000"); err != nil {
+				t.Error(err)
+			}
+		})
+	})
+	t.Run("proxy-protocol", func(t *testing.T) {
+		t.Run("required", func(t *testing.T) {
+			if err := testTcpProxyProtocol(":8000"); err != nil {
+				t.Error(err)
+			}
+		})
+		t.Run("optional-silent-client", func(t *testing.T) {
+			if err := testProxyOptionalSilent(":8000"); err != nil {
+				t.Error(err)
+			}
+		})
+	})
+	t.Run("stats", func(t *testing.T) {
+		if err := testTcpStats(":8000"); err != nil {
+			t.Error(err)
+		}
+	})
+	t.Run("logger", func(t *testing.T) {
+		if err := testLogger(":8000"); err != nil {
+			t.Error(err)
+		}
+	})
+	t.Run("limit", func(t *testing.T) {
+		t.Run("per-ip", func(t *testing.T) {
+			if err := testTcpLimit(":8000", TcpOption{MaxConnectionsPerIP: 1}, RejectMaxConnectionsPerIP); err != nil {
+				t.Error(err)
+			}
+		})
+		t.Run("total", func(t *testing.T) {
+			if err := testTcpLimit(":8000", TcpOption{MultiCore: 2, MaxConnections: 1}, RejectMaxConnections); err != nil {
+				t.Error(err)
+			}
+		})
+		t.Run("rate", func(t *testing.T) {
+			if err := testTcpLimit(":8000", TcpOption{AcceptRate: 0.001, AcceptBurst: 1}, RejectRateLimited); err != nil {
+				t.Error(err)
+			}
+		})
+	})
+	t.Run("access-control", func(t *testing.T) {
+		if err := testAccessControl(":8000"); err != nil {
+			t.Error(err)
+		}
+	})
+	t.Run("load-balancing", func(t *testing.T) {
+		t.Run("least-connections", func(t *testing.T) {
+			if err := testLoadBalancing(":8000", TcpOption{LoadBalancing: LeastConnections}, 4, true, []int64{1, 1, 1, 1}); err != nil {
+				t.Error(err)
+			}
+		})
+		t.Run("least-connections-burst", func(t *testing.T) {
+			if err := testLoadBalancing(":8000", TcpOption{LoadBalancing: LeastConnections}, 16, false, []int64{4, 4, 4, 4}); err != nil {
+				t.Error(err)
+			}
+		})
+		t.Run("source-addr-hash", func(t *testing.T) {
+			if err := testLoadBalancing(":8000", TcpOption{LoadBalancing: SourceAddrHash}, 4, true, nil); err != nil {
+				t.Error(err)
+			}
+		})
+		t.Run("custom", func(t *testing.T) {
+			if err := testLoadBalancing(":8000", TcpOption{LoadBalancer: lastLoop{}}, 4, true, []int64{0, 0, 0, 4}); err != nil {
+				t.Error(err)
+			}
+		})
+	})
+	t.Run("buffer-access", func(t *testing.T) {
+		if err := testBufferAccess(); err != nil {
+			t.Error(err)
+		}
+	})
+	t.Run("http-reader", func(t *testing.T) {
+		if err := testHTTPReader(); err != nil {
+			t.Error(err)
+		}
+	})
+	t.Run("panic", func(t *testing.T) {
+		t.Run("loop", func(t *testing.T) {
+			if err := testPanic(TcpOption{MultiCore: 1}); err != nil {
+				t.Error(err)
+			}
+		})
+		t.Run("worker-pool", func(t *testing.T) {
+			if err := testPanic(TcpOption{MultiCore: 1, WorkerPool: 2}); err != nil {
+				t.Error(err)
+			}
+		})
+		t.Run("tick", func(t *testing.T) {
+			if err := testTickPanic(); err != nil {
+				t.Error(err)
+			}
+		})
+	})
+	t.Run("worker-pool", func(t *testing.T) {
+		t.Run("codec", func(t *testing.T) {
+			if err := testWorkerPool(&LineBasedFrameCodec{}, 1); err != nil {
+				t.Error(err)
+			}
+		})
+		t.Run("raw", func(t *testing.T) {
+			if err := testWorkerPool(nil, 1); err != nil {
+				t.Error(err)
+			}
+		})
+		// 排队的连接在其他event-loop的worker返回结果后提交
+		t.Run("multi-loop", func(t *testing.T) {
+			if err := testWorkerPool(nil, 4); err != nil {
+				t.Error(err)
+			}
+		})
+		t.Run("reset-while-working", func(t *testing.T) {
+			if err := testWorkerPoolReset(); err != nil {
+				t.Error(err)
+			}
+		})
+		t.Run("shutdown-while-working", func(t *testing.T) {
+			if err := testWorkerPoolShutdown(); err != nil {
+				t.Error(err)
+			}
+		})
+	})
+	t.Run("upgrade", func(t *testing.T) {
+		if err := testUpgrade(); err != nil {
+			t.Error(err)
+		}
+	})
+	t.Run("systemd", func(t *testing.T) {
+		if err := testSystemd(); err != nil {
+			t.Error(err)
+		}
+	})
+	t.Run("multi-listener", func(t *testing.T) {
+		t.Run("reactor", func(t *testing.T) {
+			if err := testMultiService(TcpOption{MultiCore: 2}); err != nil {
+				t.Error(err)
+			}
+		})
+		t.Run("reuse-port", func(t *testing.T) {
+			if err := testMultiService(TcpOption{MultiCore: 2, ReusePort: true}); err != nil {
+				t.Error(err)
+			}
+		})
+	})
 	t.Run("udp", func(t *testing.T) {
 		t.Run("reuse-base", func(t *testing.T) {
 			if err := testUdpService(":8000", UdpOption{ReusePort: true}); err != nil {
@@ -35,6 +431,7 @@ func TestCnet(t *testing.T) {
 }
 
 type serverCallback struct {
+	EventServer
 	connTotal, connected, close int64
 	spanDown, spanUp            int64
 }
@@ -92,25 +489,2614 @@ func (sc *serverCallback) OnWakenHandler(c Conn) (out []byte, op Operation) {
 }
 
 func testTcpService(addr string, opt TcpOption) error {
-	var c = Cnet{
-		Network:      Tcp,
-		Callback:     &serverCallback{},
-		Addr:         ":8000",
-		MultiCore:    4,
-		TcpKeepAlive: time.Minute,
-		ReusePort:    true,
+	var (
+		srv Server
+		c   net.Conn
+		rcv []byte
+		err error
+	)
+	if srv, err = StartTcpService(&serverCallback{}, addr, opt); err != nil {
+		return err
+	}
+	defer shutdown(srv)
+	if c, err = net.Dial("tcp", "127.0.0.1"+addr); err != nil {
+		return err
+	}
+	defer c.Close()
+	_ = c.SetDeadline(time.Now().Add(3 * time.Second))
+	rcv = make([]byte, len("hello client, welcome to connection\n"))
+	if _, err = io.ReadFull(c, rcv); err != nil {
+		return err
 	}
-	return c.Listener()
+	if _, err = c.Write([]byte("ping")); err != nil {
+		return err
+	}
+	rcv = make([]byte, len("receive ping"))
+	if _, err = io.ReadFull(c, rcv); err != nil {
+		return err
+	}
+	if string(rcv) != "receive ping" {
+		return fmt.Errorf("unexpected reply: %q", rcv)
+	}
+	return nil
 }
 
 func testUdpService(addr string, opt UdpOption) error {
-	var c = Cnet{
-		Network:      Udp,
-		Callback:     &serverCallback{},
-		Addr:         ":8000",
-		MultiCore:    4,
-		TcpKeepAlive: time.Minute,
-		ReusePort:    true,
-	}
-	return c.Listener()
+	var (
+		srv Server
+		c   net.Conn
+		n   int
+		rcv = make([]byte, 64)
+		err error
+	)
+	if srv, err = StartUdpService(&serverCallback{}, addr, opt); err != nil {
+		return err
+	}
+	defer shutdown(srv)
+	if c, err = net.Dial("udp", "127.0.0.1"+addr); err != nil {
+		return err
+	}
+	defer c.Close()
+	_ = c.SetDeadline(time.Now().Add(3 * time.Second))
+	if _, err = c.Write([]byte("ping")); err != nil {
+		return err
+	}
+	if n, err = c.Read(rcv); err != nil {
+		return err
+	}
+	if string(rcv[:n]) != "reply: ping" {
+		return fmt.Errorf("unexpected reply: %q", rcv[:n])
+	}
+	return nil
+}
+
+func shutdown(srv Server) {
+	var ctx, cancel = context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	_ = srv.Shutdown(ctx)
+}
+
+type timeoutCallback struct {
+	serverCallback
+	closed chan error
+}
+
+func (tc *timeoutCallback) OnConnClosed(c Conn, err error) (op Operation) {
+	tc.closed <- err
+	return
+}
+
+func testTcpTimeout(addr string, opt TcpOption, expect error) error {
+	var (
+		srv Server
+		c   net.Conn
+		cb  = &timeoutCallback{closed: make(chan error, 1)}
+		err error
+	)
+	if srv, err = StartTcpService(cb, addr, opt); err != nil {
+		return err
+	}
+	defer shutdown(srv)
+	if c, err = net.Dial("tcp", "127.0.0.1"+addr); err != nil {
+		return err
+	}
+	defer c.Close()
+	_ = c.SetDeadline(time.Now().Add(3 * time.Second))
+	if _, err = io.Copy(ioutil.Discard, c); err != nil {
+		return err
+	}
+	select {
+	case err = <-cb.closed:
+		if err != expect {
+			return fmt.Errorf("unexpected close error: %v", err)
+		}
+	case <-time.After(time.Second):
+		return fmt.Errorf("connection is not closed")
+	}
+	return nil
+}
+
+type timerCallback struct {
+	serverCallback
+	ticks int64
+}
+
+func (tc *timerCallback) OnConnOpened(c Conn) (out []byte, op Operation) {
+	var n int
+	c.Every(20*time.Millisecond, func(c Conn) ([]byte, Operation) {
+		if n++; n > 3 {
+			return nil, Close
+		}
+		return []byte("tick"), None
+	})
+	c.AfterFunc(time.Hour, func(c Conn) ([]byte, Operation) {
+		return []byte("never"), None
+	})
+	return
+}
+
+func (tc *timerCallback) OnTick() (delay time.Duration, op Operation) {
+	atomic.AddInt64(&tc.ticks, 1)
+	return 10 * time.Millisecond, None
+}
+
+func testTcpTimer(addr string, opt TcpOption) error {
+	var (
+		srv Server
+		c   net.Conn
+		rcv []byte
+		cb  = &timerCallback{}
+		err error
+	)
+	if srv, err = StartTcpService(cb, addr, opt); err != nil {
+		return err
+	}
+	defer shutdown(srv)
+	if c, err = net.Dial("tcp", "127.0.0.1"+addr); err != nil {
+		return err
+	}
+	defer c.Close()
+	_ = c.SetDeadline(time.Now().Add(3 * time.Second))
+	if rcv, err = ioutil.ReadAll(c); err != nil {
+		return err
+	}
+	if string(rcv) != "tickticktick" {
+		return fmt.Errorf("unexpected reply: %q", rcv)
+	}
+	if atomic.LoadInt64(&cb.ticks) < 2 {
+		return fmt.Errorf("OnTick is not called periodically")
+	}
+	return nil
+}
+
+func testCodecConfig() error {
+	if _, err := NewFixedLengthFrameCodec(0); err != ErrInvalidFixedLength {
+		return fmt.Errorf("fixed length 0: %v", err)
+	}
+	if _, err := NewFixedLengthFrameCodec(-1); err != ErrInvalidFixedLength {
+		return fmt.Errorf("fixed length -1: %v", err)
+	}
+	if _, err := NewDelimiterBasedFrameCodec(nil, 0); err != ErrEmptyDelimiter {
+		return fmt.Errorf("empty delimiter: %v", err)
+	}
+	if _, err := NewDelimiterBasedFrameCodec([]byte("\n"), -1); err != ErrInvalidCodecConfig {
+		return fmt.Errorf("negative max frame length: %v", err)
+	}
+	for _, n := range []int{0, 5, 16} {
+		if _, err := NewLengthFieldBasedFrameCodec(EncoderConfig{LengthFieldLength: n}, DecoderConfig{LengthFieldLength: 4}); err != ErrUnsupportedLength {
+			return fmt.Errorf("encoder LengthFieldLength %d: %v", n, err)
+		}
+		if _, err := NewLengthFieldBasedFrameCodec(EncoderConfig{LengthFieldLength: 4}, DecoderConfig{LengthFieldLength: n}); err != ErrUnsupportedLength {
+			return fmt.Errorf("decoder LengthFieldLength %d: %v", n, err)
+		}
+	}
+	if _, err := NewLengthFieldBasedFrameCodec(EncoderConfig{LengthFieldLength: 4}, DecoderConfig{LengthFieldLength: 4, InitialBytesToStrip: -1}); err != ErrInvalidCodecConfig {
+		return fmt.Errorf("negative InitialBytesToStrip: %v", err)
+	}
+	return nil
+}
+
+// Encode不能修改调用方切片的底层数组
+func testCodecEncodeCopy() error {
+	var delimiter, err = NewDelimiterBasedFrameCodec([]byte("$$"), 0)
+	if err != nil {
+		return err
+	}
+	for _, codec := range []ICodec{&LineBasedFrameCodec{}, delimiter} {
+		var backing = []byte("abcdef")
+		var out []byte
+		if out, err = codec.Encode(nil, backing[:3]); err != nil {
+			return err
+		}
+		if string(backing) != "abcdef" {
+			return fmt.Errorf("%T.Encode overwrote the caller's array: %q", codec, backing)
+		}
+		if len(out) < 3 || string(out[:3]) != "abc" {
+			return fmt.Errorf("%T.Encode: unexpected output %q", codec, out)
+		}
+	}
+	return nil
+}
+
+// 帧长度超过MaxFrameLength时关闭连接
+func testCodecFrameTooLong(addr string, codec ICodec, packet []byte) error {
+	var (
+		cb  = &closedCallback{closed: make(chan error, 1)}
+		srv Server
+		c   net.Conn
+		err error
+	)
+	if srv, err = StartTcpService(cb, addr, TcpOption{MultiCore: 1, Codec: codec}); err != nil {
+		return err
+	}
+	defer shutdown(srv)
+	if c, err = net.Dial("tcp", "127.0.0.1"+addr); err != nil {
+		return err
+	}
+	defer c.Close()
+	_ = c.SetDeadline(time.Now().Add(3 * time.Second))
+	if _, err = c.Write(packet); err != nil {
+		return err
+	}
+	select {
+	case err = <-cb.closed:
+		if err != ErrFrameTooLong {
+			return fmt.Errorf("connection closed with %v, expect ErrFrameTooLong", err)
+		}
+	case <-time.After(3 * time.Second):
+		return fmt.Errorf("connection is not closed")
+	}
+	if _, err = c.Read(make([]byte, 1)); err == nil {
+		return fmt.Errorf("expect connection closed")
+	}
+	return nil
+}
+
+// 记录连接关闭的原因
+type closedCallback struct {
+	EventServer
+	closed chan error
+}
+
+func (cc *closedCallback) OnConnClosed(c Conn, err error) (op Operation) {
+	cc.closed <- err
+	return
+}
+
+type codecCallback struct {
+	serverCallback
+}
+
+func (cc *codecCallback) OnConnOpened(c Conn) (out []byte, op Operation) {
+	return
+}
+
+// 回显解出的帧
+func (cc *codecCallback) ConnHandler(c Conn) (out []byte, op Operation) {
+	return append([]byte(nil), c.ReadFrame()...), None
+}
+
+// 分多次发送packets，期望收到frames编码后的回显
+func testTcpCodec(addr string, codec ICodec, frames []string, packets ...[]byte) error {
+	var (
+		srv    Server
+		c      net.Conn
+		expect []byte
+		err    error
+	)
+	if srv, err = StartTcpService(&codecCallback{}, addr, TcpOption{MultiCore: 2, Codec: codec}); err != nil {
+		return err
+	}
+	defer shutdown(srv)
+	for _, frame := range frames {
+		var out []byte
+		if out, err = codec.Encode(nil, []byte(frame)); err != nil {
+			return err
+		}
+		expect = append(expect, out...)
+	}
+	if c, err = net.Dial("tcp", "127.0.0.1"+addr); err != nil {
+		return err
+	}
+	defer c.Close()
+	_ = c.SetDeadline(time.Now().Add(3 * time.Second))
+	for _, packet := range packets {
+		if _, err = c.Write(packet); err != nil {
+			return err
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	var rcv = make([]byte, len(expect))
+	if _, err = io.ReadFull(c, rcv); err != nil {
+		return err
+	}
+	if string(rcv) != string(expect) {
+		return fmt.Errorf("unexpected reply: %q", rcv)
+	}
+	return nil
+}
+
+// 启动完成后立即关闭服务
+type lifecycleCallback struct {
+	EventServer
+	init, shutdown Server
+}
+
+func (lc *lifecycleCallback) OnInitComplete(srv Server) (op Operation) {
+	lc.init = srv
+	return Shutdown
+}
+
+func (lc *lifecycleCallback) OnShutdown(srv Server) {
+	lc.shutdown = srv
+}
+
+// 收到数据后在回调中调用Shutdown
+type shutdownCallback struct {
+	EventServer
+	srv      Server
+	ready    chan struct{} // closed after srv is set
+	returned chan error
+}
+
+func (sc *shutdownCallback) OnInitComplete(srv Server) (op Operation) {
+	sc.srv = srv
+	close(sc.ready)
+	return
+}
+
+func (sc *shutdownCallback) shutdown() {
+	<-sc.ready
+	var ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	sc.returned <- sc.srv.Shutdown(ctx)
+}
+
+func (sc *shutdownCallback) ConnHandler(c Conn) (out []byte, op Operation) {
+	sc.shutdown()
+	return
+}
+
+func (sc *shutdownCallback) PackHandler(pack []byte, p Pconn) (out []byte, op Operation) {
+	sc.shutdown()
+	return
+}
+
+type hookCallback struct {
+	EventServer
+	init     bool // OnInitComplete或OnShutdown中调用Shutdown
+	returned chan error
+}
+
+func (hc *hookCallback) shutdown(srv Server) {
+	var ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	var err = srv.Shutdown(ctx)
+	srv.Wait()
+	hc.returned <- err
+}
+
+func (hc *hookCallback) OnInitComplete(srv Server) (op Operation) {
+	if hc.init {
+		hc.shutdown(srv)
+	}
+	return
+}
+
+func (hc *hookCallback) OnShutdown(srv Server) {
+	if !hc.init {
+		hc.shutdown(srv)
+	}
+}
+
+func (hc *hookCallback) ConnHandler(c Conn) (out []byte, op Operation) {
+	return
+}
+
+func (hc *hookCallback) PackHandler(pack []byte, p Pconn) (out []byte, op Operation) {
+	return
+}
+
+// OnInitComplete或OnShutdown中调用Shutdown与Wait
+func testShutdownInHook(network, addr string, init bool) error {
+	var (
+		cb      = &hookCallback{init: init, returned: make(chan error, 1)}
+		started = make(chan Server, 1)
+		srv     Server
+		err     error
+	)
+	go func() {
+		var (
+			s   Server
+			err error
+		)
+		if network == "udp" {
+			s, err = StartUdpService(cb, addr, UdpOption{})
+		} else {
+			s, err = StartTcpService(cb, addr, TcpOption{MultiCore: 2})
+		}
+		if err != nil {
+			cb.returned <- err
+		}
+		started <- s
+	}()
+	select {
+	case srv = <-started:
+	case <-time.After(3 * time.Second):
+		return fmt.Errorf("start service blocked")
+	}
+	if srv == nil {
+		return <-cb.returned
+	}
+	if !init {
+		go shutdown(srv)
+	}
+	select {
+	case err = <-cb.returned:
+		if err != nil {
+			return fmt.Errorf("Shutdown in hook returned %v", err)
+		}
+	case <-time.After(3 * time.Second):
+		return fmt.Errorf("Shutdown in hook blocked")
+	}
+	var done = make(chan struct{})
+	go func() {
+		srv.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-time.After(3 * time.Second):
+		return fmt.Errorf("service is not closed")
+	}
+}
+
+func testShutdownInCallback(network, addr string, opt TcpOption) error {
+	var (
+		cb  = &shutdownCallback{ready: make(chan struct{}), returned: make(chan error, 1)}
+		srv Server
+		c   net.Conn
+		err error
+	)
+	if network == "udp" {
+		srv, err = StartUdpService(cb, addr, UdpOption{})
+	} else {
+		srv, err = StartTcpService(cb, addr, opt)
+	}
+	if err != nil {
+		return err
+	}
+	if c, err = net.Dial(network, "127.0.0.1"+addr); err != nil {
+		shutdown(srv)
+		return err
+	}
+	defer c.Close()
+	if _, err = c.Write([]byte("bye")); err != nil {
+		shutdown(srv)
+		return err
+	}
+	select {
+	case err = <-cb.returned:
+		if err != nil {
+			return fmt.Errorf("Shutdown in callback returned %v", err)
+		}
+	case <-time.After(3 * time.Second):
+		return fmt.Errorf("Shutdown in callback blocked")
+	}
+	var done = make(chan struct{})
+	go func() {
+		srv.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-time.After(3 * time.Second):
+		return fmt.Errorf("server is not stopped after Shutdown in callback")
+	}
+}
+
+type unixCallback struct {
+	serverCallback
+}
+
+// 回复对端进程的pid
+func (uc *unixCallback) OnConnOpened(c Conn) (out []byte, op Operation) {
+	var cred, err = c.PeerCred()
+	if err != nil {
+		return []byte(err.Error()), Close
+	}
+	return []byte(strconv.Itoa(int(cred.Pid))), Close
+}
+
+func testUnixService(path string) error {
+	var (
+		srv Server
+		c   net.Conn
+		rcv []byte
+		fi  os.FileInfo
+		err error
+	)
+	// 残留的socket文件
+	var stale *net.UnixListener
+	if stale, err = net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"}); err != nil {
+		return err
+	}
+	stale.SetUnlinkOnClose(false)
+	_ = stale.Close()
+
+	if srv, err = StartUnixService(&unixCallback{}, path, TcpOption{MultiCore: 2, SocketPerm: 0600}); err != nil {
+		return err
+	}
+	defer shutdown(srv)
+	if fi, err = os.Stat(path); err != nil {
+		return err
+	}
+	if fi.Mode().Perm() != 0600 {
+		return fmt.Errorf("unexpected socket file perm: %v", fi.Mode().Perm())
+	}
+	if c, err = net.Dial("unix", path); err != nil {
+		return err
+	}
+	defer c.Close()
+	_ = c.SetDeadline(time.Now().Add(3 * time.Second))
+	if rcv, err = ioutil.ReadAll(c); err != nil {
+		return err
+	}
+	if string(rcv) != strconv.Itoa(os.Getpid()) {
+		return fmt.Errorf("unexpected peer pid: %q", rcv)
+	}
+	return nil
+}
+
+// 路径上有其他进程(这里是同进程的net监听)在监听时启动服务失败，且不删除其socket文件
+func testUnixSocketInUse(path string) error {
+	for _, live := range []string{"unixgram", "unix"} {
+		var (
+			closer io.Closer
+			err    error
+		)
+		if live == "unixgram" {
+			closer, err = net.ListenUnixgram(live, &net.UnixAddr{Name: path, Net: live})
+		} else {
+			closer, err = net.ListenUnix(live, &net.UnixAddr{Name: path, Net: live})
+		}
+		if err != nil {
+			return err
+		}
+		for _, network := range []string{"unixgram", "unix"} {
+			var srv Server
+			if network == "unixgram" {
+				srv, err = StartUnixgramService(&serverCallback{}, path, UdpOption{MultiCore: 1})
+			} else {
+				srv, err = StartUnixService(&serverCallback{}, path, TcpOption{MultiCore: 1})
+			}
+			if err == nil {
+				shutdown(srv)
+			}
+			if err != ErrSocketInUse {
+				_ = closer.Close()
+				return fmt.Errorf("%s service on live %s socket: %v, expect ErrSocketInUse", network, live, err)
+			}
+			if _, err = os.Stat(path); err != nil {
+				_ = closer.Close()
+				return fmt.Errorf("%s service removed live %s socket file: %v", network, live, err)
+			}
+		}
+		_ = closer.Close()
+		// 关闭后残留的数据报socket文件可被清理
+		if live == "unixgram" {
+			var srv, err = StartUnixgramService(&serverCallback{}, path, UdpOption{MultiCore: 1})
+			if err != nil {
+				return fmt.Errorf("unixgram service on stale socket: %v", err)
+			}
+			shutdown(srv)
+		}
+		_ = os.Remove(path)
+	}
+	return nil
+}
+
+func testUnixgramService(path, clientPath string) error {
+	var (
+		srv Server
+		c   *net.UnixConn
+		n   int
+		rcv = make([]byte, 64)
+		err error
+	)
+	if srv, err = StartUnixgramService(&serverCallback{}, path, UdpOption{MultiCore: 2}); err != nil {
+		return err
+	}
+	if c, err = net.DialUnix("unixgram", &net.UnixAddr{Name: clientPath, Net: "unixgram"}, &net.UnixAddr{Name: path, Net: "unixgram"}); err != nil {
+		shutdown(srv)
+		return err
+	}
+	defer c.Close()
+	_ = c.SetDeadline(time.Now().Add(3 * time.Second))
+	if _, err = c.Write([]byte("ping")); err != nil {
+		shutdown(srv)
+		return err
+	}
+	if n, err = c.Read(rcv); err != nil {
+		shutdown(srv)
+		return err
+	}
+	shutdown(srv)
+	if string(rcv[:n]) != "reply: ping" {
+		return fmt.Errorf("unexpected reply: %q", rcv[:n])
+	}
+	if _, err = os.Stat(path); !os.IsNotExist(err) {
+		return fmt.Errorf("socket file is not removed")
+	}
+	return nil
+}
+
+type echoCallback struct {
+	EventServer
+}
+
+func (ec *echoCallback) ConnHandler(c Conn) (out []byte, op Operation) {
+	var n, rcv = c.Read()
+	out = append(out, rcv...)
+	c.ShiftN(n)
+	return
+}
+
+type clientCallback struct {
+	EventServer
+	received chan string
+	closed   chan error
+	inits    int32
+}
+
+func (cc *clientCallback) OnInitComplete(srv Server) (op Operation) {
+	atomic.AddInt32(&cc.inits, 1)
+	return
+}
+
+func (cc *clientCallback) ConnHandler(c Conn) (out []byte, op Operation) {
+	var n, rcv = c.Read()
+	cc.received <- string(rcv)
+	c.ShiftN(n)
+	return
+}
+
+func (cc *clientCallback) OnConnClosed(c Conn, err error) (op Operation) {
+	cc.closed <- err
+	return
+}
+
+func testTcpClient(addr string, attach bool) error {
+	var (
+		srv Server
+		cli *Client
+		c   Conn
+		rcv string
+		cb  = &clientCallback{received: make(chan string, 16), closed: make(chan error, 1)}
+		err error
+	)
+	if srv, err = StartTcpService(&echoCallback{}, addr, TcpOption{MultiCore: 2}); err != nil {
+		return err
+	}
+	defer shutdown(srv)
+	if attach {
+		cli, err = NewClientWithServer(cb, srv)
+	} else {
+		cli, err = NewClient(cb, TcpOption{MultiCore: 2, ConnectTimeout: time.Second})
+	}
+	if err != nil {
+		return err
+	}
+	defer cli.Close()
+	// 独立event-loop的客户端与服务端的生命周期一致
+	if inits := atomic.LoadInt32(&cb.inits); attach && inits != 0 || !attach && inits != 1 {
+		return fmt.Errorf("OnInitComplete is called %d times", inits)
+	}
+	// 连接未监听的端口
+	if _, err = cli.Dial("127.0.0.1:1"); err == nil {
+		return fmt.Errorf("dial to a closed port succeeded")
+	}
+	if c, err = cli.Dial("127.0.0.1" + addr); err != nil {
+		return err
+	}
+	if err = c.AsyncWrite([]byte("ping\n")); err != nil {
+		return err
+	}
+	for len(rcv) < len("ping\n") {
+		select {
+		case data := <-cb.received:
+			rcv += data
+		case <-time.After(3 * time.Second):
+			return fmt.Errorf("no reply received")
+		}
+	}
+	if rcv != "ping\n" {
+		return fmt.Errorf("unexpected reply: %q", rcv)
+	}
+	if err = c.Close(); err != nil {
+		return err
+	}
+	select {
+	case <-cb.closed:
+	case <-time.After(3 * time.Second):
+		return fmt.Errorf("connection is not closed")
+	}
+	if attach {
+		return nil
+	}
+	// 关闭后Dial失败，连接的缓冲区放回缓冲池
+	_ = cli.Close()
+	for i := 0; i < 100 && srv.Stats().Connections != 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	// 连接未监听的端口，避免服务端accept影响缓冲池计数
+	var before = buf.PoolStats()
+	if _, err = cli.Dial("127.0.0.1:1"); err == nil {
+		return fmt.Errorf("dial with a closed client succeeded")
+	}
+	if after := buf.PoolStats(); after.Gets-before.Gets != after.Puts-before.Puts {
+		return fmt.Errorf("buffers are not released after failed dial: gets %d, puts %d",
+			after.Gets-before.Gets, after.Puts-before.Puts)
+	}
+	return nil
+}
+
+// dialProxyCallback 收到数据后在ConnHandler中异步连接上游并转发，上游的回复写回下游
+type dialProxyCallback struct {
+	EventServer
+	upstream string
+	srv      Server
+	cli      *Client
+	ready    chan struct{} // closed after srv and cli are set
+	dialErr  chan error    // error of the blocking Dial in ConnHandler
+	failed   chan error    // OnConnClosed of DialAsync to a closed port
+}
+
+func (pc *dialProxyCallback) OnInitComplete(srv Server) (op Operation) {
+	pc.srv = srv
+	pc.cli, _ = NewClientWithServer(&failedCallback{failed: pc.failed}, srv)
+	close(pc.ready)
+	return
+}
+
+func (pc *dialProxyCallback) ConnHandler(c Conn) (out []byte, op Operation) {
+	<-pc.ready
+	var n, rcv = c.Read()
+	var pending = append([]byte(nil), rcv...)
+	c.ShiftN(n)
+	var _, err = pc.cli.Dial(pc.upstream)
+	pc.dialErr <- err
+	if err = pc.cli.DialAsync("127.0.0.1:1"); err != nil {
+		pc.failed <- err
+	}
+	var up, _ = NewClientWithServer(&upstreamCallback{down: c, pending: pending}, pc.srv)
+	if err = up.DialAsync(pc.upstream); err != nil {
+		return nil, Close
+	}
+	return
+}
+
+type failedCallback struct {
+	EventServer
+	failed chan error
+}
+
+func (fc *failedCallback) OnConnOpened(c Conn) (out []byte, op Operation) {
+	fc.failed <- fmt.Errorf("dial to a closed port succeeded")
+	return
+}
+
+func (fc *failedCallback) OnConnClosed(c Conn, err error) (op Operation) {
+	fc.failed <- err
+	return
+}
+
+type upstreamCallback struct {
+	EventServer
+	down    Conn
+	pending []byte
+}
+
+func (uc *upstreamCallback) OnConnOpened(c Conn) (out []byte, op Operation) {
+	return uc.pending, None
+}
+
+func (uc *upstreamCallback) ConnHandler(c Conn) (out []byte, op Operation) {
+	var n, rcv = c.Read()
+	_ = uc.down.AsyncWrite(append([]byte(nil), rcv...))
+	c.ShiftN(n)
+	return
+}
+
+// 在单个event-loop的回调中连接上游，阻塞的Dial返回ErrDialInLoop，DialAsync通过回调返回结果
+func testDialInCallback(addr, upstream string) error {
+	var (
+		up, srv Server
+		c       net.Conn
+		cb      = &dialProxyCallback{
+			upstream: "127.0.0.1" + upstream,
+			ready:    make(chan struct{}),
+			dialErr:  make(chan error, 1),
+			failed:   make(chan error, 1),
+		}
+		err error
+	)
+	if up, err = StartTcpService(&echoCallback{}, upstream, TcpOption{MultiCore: 1}); err != nil {
+		return err
+	}
+	defer shutdown(up)
+	if srv, err = StartTcpService(cb, addr, TcpOption{MultiCore: 1}); err != nil {
+		return err
+	}
+	defer shutdown(srv)
+	if c, err = net.Dial("tcp", "127.0.0.1"+addr); err != nil {
+		return err
+	}
+	defer c.Close()
+	_ = c.SetDeadline(time.Now().Add(3 * time.Second))
+	if _, err = c.Write([]byte("ping")); err != nil {
+		return err
+	}
+	var rcv = make([]byte, 4)
+	if _, err = io.ReadFull(c, rcv); err != nil {
+		return err
+	}
+	if string(rcv) != "ping" {
+		return fmt.Errorf("unexpected reply: %q", rcv)
+	}
+	if err = <-cb.dialErr; err != ErrDialInLoop {
+		return fmt.Errorf("Dial in callback returned %v, expect %v", err, ErrDialInLoop)
+	}
+	select {
+	case err = <-cb.failed:
+		if err == nil {
+			return fmt.Errorf("OnConnClosed of failed DialAsync received nil error")
+		}
+	case <-time.After(3 * time.Second):
+		return fmt.Errorf("OnConnClosed of failed DialAsync is not called")
+	}
+	return nil
+}
+
+type writevCallback struct {
+	EventServer
+	chunks [][]byte
+}
+
+// 连接建立后异步写出全部数据块，每次写出一个头部与一个数据块
+func (wc *writevCallback) OnConnOpened(c Conn) (out []byte, op Operation) {
+	go func() {
+		for i, chunk := range wc.chunks {
+			_ = c.AsyncWritev([][]byte{{byte(i)}, chunk})
+		}
+	}()
+	return
+}
+
+func testTcpWritev(addr string) error {
+	var (
+		srv    Server
+		c      net.Conn
+		cb     = &writevCallback{}
+		expect []byte
+		err    error
+	)
+	for i := 0; i < 64; i++ {
+		var chunk = bytes.Repeat([]byte{byte(i)}, 10000+i)
+		cb.chunks = append(cb.chunks, chunk)
+		expect = append(append(expect, byte(i)), chunk...)
+	}
+	if srv, err = StartTcpService(cb, addr, TcpOption{MultiCore: 2}); err != nil {
+		return err
+	}
+	defer shutdown(srv)
+	if c, err = net.Dial("tcp", "127.0.0.1"+addr); err != nil {
+		return err
+	}
+	defer c.Close()
+	_ = c.SetDeadline(time.Now().Add(3 * time.Second))
+	// 延迟读取使outBuf中积压数据
+	time.Sleep(50 * time.Millisecond)
+	var rcv = make([]byte, len(expect))
+	if _, err = io.ReadFull(c, rcv); err != nil {
+		return err
+	}
+	if !bytes.Equal(rcv, expect) {
+		return fmt.Errorf("unexpected data received")
+	}
+	return nil
+}
+
+type backpressureCallback struct {
+	EventServer
+	full                   int64 // times of ErrWriteBufferFull
+	backpressure, writable chan struct{}
+}
+
+const backpressureTotal = 8 << 20
+
+// 写入backpressureTotal字节，超过WriteBufferLimit时稍后重试
+func (bc *backpressureCallback) OnConnOpened(c Conn) (out []byte, op Operation) {
+	go func() {
+		var chunk = make([]byte, 32<<10)
+		for n := 0; n < backpressureTotal; {
+			switch c.AsyncWrite(chunk) {
+			case nil:
+				n += len(chunk)
+			case ErrWriteBufferFull:
+				atomic.AddInt64(&bc.full, 1)
+				time.Sleep(time.Millisecond)
+			default:
+				return
+			}
+		}
+	}()
+	return
+}
+
+func (bc *backpressureCallback) OnBackpressure(c Conn, pending int) {
+	select {
+	case bc.backpressure <- struct{}{}:
+	default:
+	}
+}
+
+func (bc *backpressureCallback) OnWritable(c Conn) {
+	select {
+	case bc.writable <- struct{}{}:
+	default:
+	}
+}
+
+func testTcpBackpressure(addr string) error {
+	var (
+		srv Server
+		c   net.Conn
+		cb  = &backpressureCallback{
+			backpressure: make(chan struct{}, 1),
+			writable:     make(chan struct{}, 1),
+		}
+		opt = TcpOption{
+			MultiCore:                2,
+			WriteBufferHighWatermark: 256 << 10,
+			WriteBufferLowWatermark:  64 << 10,
+			WriteBufferLimit:         1 << 20,
+		}
+		err error
+	)
+	if srv, err = StartTcpService(cb, addr, opt); err != nil {
+		return err
+	}
+	defer shutdown(srv)
+	if c, err = net.Dial("tcp", "127.0.0.1"+addr); err != nil {
+		return err
+	}
+	defer c.Close()
+	// 不读取数据直至outBuf超过高水位
+	select {
+	case <-cb.backpressure:
+	case <-time.After(3 * time.Second):
+		return fmt.Errorf("OnBackpressure is not called")
+	}
+	_ = c.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err = io.CopyN(ioutil.Discard, c, backpressureTotal); err != nil {
+		return err
+	}
+	select {
+	case <-cb.writable:
+	case <-time.After(time.Second):
+		return fmt.Errorf("OnWritable is not called")
+	}
+	if atomic.LoadInt64(&cb.full) == 0 {
+		return fmt.Errorf("write buffer limit is not applied")
+	}
+	return nil
+}
+
+type overflowCallback struct {
+	EventServer
+	total  int
+	result chan error // AsyncWrite返回的错误，全部写入时为nil
+	closed chan error
+}
+
+// 对端不读取时持续AsyncWrite，直至写入total字节或返回错误
+func (oc *overflowCallback) OnConnOpened(c Conn) (out []byte, op Operation) {
+	go func() {
+		var chunk = make([]byte, 64<<10)
+		for n := 0; n < oc.total; n += len(chunk) {
+			if err := c.AsyncWrite(chunk); err != nil {
+				oc.result <- err
+				return
+			}
+		}
+		oc.result <- nil
+	}()
+	return
+}
+
+func (oc *overflowCallback) OnConnClosed(c Conn, err error) (op Operation) {
+	oc.closed <- err
+	return
+}
+
+func testAsyncWriteOverflow(addr string, policy OverflowPolicy) error {
+	var (
+		cb = &overflowCallback{
+			total:  32 << 20,
+			result: make(chan error, 1),
+			closed: make(chan error, 1),
+		}
+		srv, err = StartTcpService(cb, addr, TcpOption{MultiCore: 1, WriteBufferLimit: 256 << 10, WriteBufferPolicy: policy})
+		c        net.Conn
+	)
+	if err != nil {
+		return err
+	}
+	defer shutdown(srv)
+	if c, err = net.Dial("tcp", "127.0.0.1"+addr); err != nil {
+		return err
+	}
+	defer c.Close()
+	select {
+	case err = <-cb.result:
+	case <-time.After(5 * time.Second):
+		return fmt.Errorf("AsyncWrite does not return")
+	}
+	if policy == OverflowClose {
+		if err != ErrWriteBufferFull {
+			return fmt.Errorf("AsyncWrite returned %v, expect %v", err, ErrWriteBufferFull)
+		}
+		select {
+		case err = <-cb.closed:
+			if err != ErrWriteBufferFull {
+				return fmt.Errorf("OnConnClosed received %v, expect %v", err, ErrWriteBufferFull)
+			}
+			return nil
+		case <-time.After(3 * time.Second):
+			return fmt.Errorf("connection is not closed")
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("AsyncWrite returned %v, expect dropping data", err)
+	}
+	// 读取积压的数据，超过WriteBufferLimit的部分已丢弃
+	var (
+		buf = make([]byte, 64<<10)
+		rcv int
+		n   int
+	)
+	for {
+		_ = c.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		if n, err = c.Read(buf); err != nil {
+			break
+		}
+		rcv += n
+	}
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		return fmt.Errorf("connection is closed: %v", err)
+	}
+	if rcv == 0 || rcv >= cb.total {
+		return fmt.Errorf("received %d bytes of %d, expect part of data dropped", rcv, cb.total)
+	}
+	return nil
+}
+
+type pauseCallback struct {
+	EventServer
+	received int64
+	paused   chan Conn
+}
+
+// 收到第一次数据后暂停读取
+func (pc *pauseCallback) ConnHandler(c Conn) (out []byte, op Operation) {
+	var n, _ = c.Read()
+	c.ShiftN(n)
+	if atomic.AddInt64(&pc.received, int64(n)) == int64(n) {
+		_ = c.PauseRead()
+		pc.paused <- c
+	}
+	return
+}
+
+func testTcpPauseRead(addr string, opt TcpOption) error {
+	var (
+		srv Server
+		c   net.Conn
+		sc  Conn
+		cb  = &pauseCallback{paused: make(chan Conn, 1)}
+		err error
+	)
+	if srv, err = StartTcpService(cb, addr, opt); err != nil {
+		return err
+	}
+	defer shutdown(srv)
+	if c, err = net.Dial("tcp", "127.0.0.1"+addr); err != nil {
+		return err
+	}
+	defer c.Close()
+	if _, err = c.Write([]byte("ping")); err != nil {
+		return err
+	}
+	select {
+	case sc = <-cb.paused:
+	case <-time.After(time.Second):
+		return fmt.Errorf("ConnHandler is not called")
+	}
+	if _, err = c.Write([]byte("pong")); err != nil {
+		return err
+	}
+	time.Sleep(100 * time.Millisecond)
+	if n := atomic.LoadInt64(&cb.received); n != 4 {
+		return fmt.Errorf("received %d bytes while paused", n)
+	}
+	if err = sc.ResumeRead(); err != nil {
+		return err
+	}
+	for i := 0; i < 100 && atomic.LoadInt64(&cb.received) != 8; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := atomic.LoadInt64(&cb.received); n != 8 {
+		return fmt.Errorf("received %d bytes after resume, expect 8", n)
+	}
+	return nil
+}
+
+type tlsCallback struct {
+	echoCallback
+	proto chan string
+}
+
+func (tc *tlsCallback) OnConnOpened(c Conn) (out []byte, op Operation) {
+	if state := c.TLSState(); state != nil {
+		tc.proto <- state.NegotiatedProtocol
+	}
+	return
+}
+
+// 生成自签名证书
+func testCertificate() (tls.Certificate, error) {
+	var key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	var template = &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "cnet"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{"localhost"},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+// 不发送ClientHello的连接由ReadTimeout关闭，握手goroutine随之退出
+func testTLSHandshakeTimeout(addr string) error {
+	var (
+		srv   Server
+		cert  tls.Certificate
+		conns []net.Conn
+		err   error
+	)
+	if cert, err = testCertificate(); err != nil {
+		return err
+	}
+	var opt = TcpOption{
+		MultiCore:   2,
+		ReadTimeout: 200 * time.Millisecond,
+		TLSConfig:   &tls.Config{Certificates: []tls.Certificate{cert}},
+	}
+	if srv, err = StartTcpService(&EventServer{}, addr, opt); err != nil {
+		return err
+	}
+	defer shutdown(srv)
+	var base = runtime.NumGoroutine()
+	for i := 0; i < 16; i++ {
+		var c net.Conn
+		if c, err = net.Dial("tcp", "127.0.0.1"+addr); err != nil {
+			return err
+		}
+		defer c.Close()
+		conns = append(conns, c)
+	}
+	for _, c := range conns {
+		_ = c.SetReadDeadline(time.Now().Add(3 * time.Second))
+		if _, err = c.Read(make([]byte, 1)); err != io.EOF {
+			return fmt.Errorf("expect connection closed by handshake timeout, got %v", err)
+		}
+	}
+	for i := 0; i < 100 && runtime.NumGoroutine() > base; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := runtime.NumGoroutine(); n > base {
+		return fmt.Errorf("%d handshake goroutines are left", n-base)
+	}
+	return nil
+}
+
+func testTcpTLS(addr string, multiCore int) error {
+	var (
+		srv  Server
+		c    *tls.Conn
+		cert tls.Certificate
+		cb   = &tlsCallback{proto: make(chan string, 1)}
+		err  error
+	)
+	if cert, err = testCertificate(); err != nil {
+		return err
+	}
+	var opt = TcpOption{
+		MultiCore: multiCore,
+		TLSConfig: &tls.Config{Certificates: []tls.Certificate{cert}, NextProtos: []string{"cnet"}},
+	}
+	if srv, err = StartTcpService(cb, addr, opt); err != nil {
+		return err
+	}
+	defer shutdown(srv)
+	var config = &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"cnet"}}
+	if c, err = tls.Dial("tcp", "127.0.0.1"+addr, config); err != nil {
+		return err
+	}
+	defer c.Close()
+	select {
+	case proto := <-cb.proto:
+		if proto != "cnet" {
+			return fmt.Errorf("negotiated protocol %q, expect cnet", proto)
+		}
+	case <-time.After(time.Second):
+		return fmt.Errorf("OnConnOpened is not called")
+	}
+	// 超过单个record长度的数据
+	var data = bytes.Repeat([]byte("0123456789abcdef"), 16<<10)
+	_ = c.SetDeadline(time.Now().Add(5 * time.Second))
+	go func() {
+		_, _ = c.Write(data)
+	}()
+	var rcv = make([]byte, len(data))
+	if _, err = io.ReadFull(c, rcv); err != nil {
+		return err
+	}
+	if !bytes.Equal(rcv, data) {
+		return fmt.Errorf("echo data mismatch")
+	}
+	// 发送close_notify后服务端关闭连接并回复close_notify
+	if err = c.CloseWrite(); err != nil {
+		return err
+	}
+	if _, err = c.Read(rcv); err != io.EOF {
+		return fmt.Errorf("read after close_notify: %v, expect EOF", err)
+	}
+	return nil
+}
+
+type proxyCallback struct {
+	echoCallback
+	opened chan *ProxyHeader
+	addr   chan string
+	closed chan error
+}
+
+func (pc *proxyCallback) OnConnOpened(c Conn) (out []byte, op Operation) {
+	pc.addr <- c.RemoteAddr()
+	pc.opened <- c.ProxyHeader()
+	return
+}
+
+func (pc *proxyCallback) OnConnClosed(c Conn, err error) (op Operation) {
+	pc.closed <- err
+	return
+}
+
+// 构造PROXY protocol v2头
+func testProxyV2(src, dst *net.TCPAddr, tlvs ...ProxyTLV) []byte {
+	var b = append([]byte(nil), proxyV2Signature...)
+	var payload []byte
+	payload = append(payload, src.IP.To4()...)
+	payload = append(payload, dst.IP.To4()...)
+	payload = append(payload, byte(src.Port>>8), byte(src.Port), byte(dst.Port>>8), byte(dst.Port))
+	for _, tlv := range tlvs {
+		payload = append(payload, tlv.Type, byte(len(tlv.Value)>>8), byte(len(tlv.Value)))
+		payload = append(payload, tlv.Value...)
+	}
+	b = append(b, 0x21, 0x11, byte(len(payload)>>8), byte(len(payload)))
+	return append(b, payload...)
+}
+
+func testTcpProxyProtocol(addr string) error {
+	var (
+		srv Server
+		cb  = &proxyCallback{
+			opened: make(chan *ProxyHeader, 1),
+			addr:   make(chan string, 1),
+			closed: make(chan error, 1),
+		}
+		opt = TcpOption{ProxyProtocol: ProxyProtocolRequired, ProxyHeaderTimeout: 200 * time.Millisecond}
+		err error
+	)
+	if srv, err = StartTcpService(cb, addr, opt); err != nil {
+		return err
+	}
+	defer shutdown(srv)
+	var check = func(header []byte, remote string, tlv []byte) error {
+		var c, err = net.Dial("tcp", "127.0.0.1"+addr)
+		if err != nil {
+			return err
+		}
+		defer c.Close()
+		// 头与数据分两次发送
+		if _, err = c.Write(header[:10]); err != nil {
+			return err
+		}
+		time.Sleep(10 * time.Millisecond)
+		if _, err = c.Write(append(header[10:], "ping"...)); err != nil {
+			return err
+		}
+		var hdr *ProxyHeader
+		select {
+		case hdr = <-cb.opened:
+		case <-time.After(time.Second):
+			return fmt.Errorf("OnConnOpened is not called")
+		}
+		if rcv := <-cb.addr; rcv != remote {
+			return fmt.Errorf("remote addr %s, expect %s", rcv, remote)
+		}
+		if v, _ := hdr.TLV(ProxyTLVAuthority); !bytes.Equal(v, tlv) {
+			return fmt.Errorf("authority TLV %q, expect %q", v, tlv)
+		}
+		var rcv = make([]byte, 4)
+		_ = c.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err = io.ReadFull(c, rcv); err != nil {
+			return err
+		}
+		if string(rcv) != "ping" {
+			return fmt.Errorf("receive %q, expect ping", rcv)
+		}
+		c.Close()
+		<-cb.closed
+		return nil
+	}
+	if err = check([]byte("PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\n"), "192.168.0.1:56324", nil); err != nil {
+		return err
+	}
+	var (
+		src = &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1234}
+		dst = &net.TCPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 443}
+	)
+	if err = check(testProxyV2(src, dst, ProxyTLV{Type: ProxyTLVAuthority, Value: []byte("example.com")}), "10.0.0.1:1234", []byte("example.com")); err != nil {
+		return err
+	}
+	// 没有PROXY头的连接被关闭
+	for _, data := range []string{"GET / HTTP/1.1\r\n", ""} {
+		var c net.Conn
+		if c, err = net.Dial("tcp", "127.0.0.1"+addr); err != nil {
+			return err
+		}
+		_, _ = c.Write([]byte(data))
+		_ = c.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err = c.Read(make([]byte, 1)); err != io.EOF {
+			c.Close()
+			return fmt.Errorf("connection without header: %v, expect EOF", err)
+		}
+		c.Close()
+	}
+	return nil
+}
+
+// 服务端先发送数据，Optional模式下客户端不发送PROXY头，超时后按普通连接打开
+func testProxyOptionalSilent(addr string) error {
+	var (
+		srv Server
+		c   net.Conn
+		opt = TcpOption{ProxyProtocol: ProxyProtocolOptional, ProxyHeaderTimeout: 100 * time.Millisecond}
+		err error
+	)
+	if srv, err = StartTcpService(&serverCallback{}, addr, opt); err != nil {
+		return err
+	}
+	defer shutdown(srv)
+	if c, err = net.Dial("tcp", "127.0.0.1"+addr); err != nil {
+		return err
+	}
+	defer c.Close()
+	_ = c.SetReadDeadline(time.Now().Add(3 * time.Second))
+	var greeting = make([]byte, len("hello client, welcome to connection\n"))
+	if _, err = io.ReadFull(c, greeting); err != nil {
+		return fmt.Errorf("no greeting from server: %v", err)
+	}
+	if string(greeting) != "hello client, welcome to connection\n" {
+		return fmt.Errorf("unexpected greeting: %q", greeting)
+	}
+	return nil
+}
+
+func testTcpStats(addr string) error {
+	var (
+		srv   Server
+		c     net.Conn
+		stats Stats
+		err   error
+	)
+	if srv, err = StartTcpService(&echoCallback{}, addr, TcpOption{MultiCore: 2}); err != nil {
+		return err
+	}
+	defer shutdown(srv)
+	if c, err = net.Dial("tcp", "127.0.0.1"+addr); err != nil {
+		return err
+	}
+	if _, err = c.Write([]byte("hello")); err != nil {
+		return err
+	}
+	_ = c.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err = io.ReadFull(c, make([]byte, 5)); err != nil {
+		return err
+	}
+	c.Close()
+	for i := 0; i < 100; i++ {
+		if stats = srv.Stats(); stats.Closed == 1 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(stats.Loops) != 2 || stats.Accepted != 1 || stats.Closed != 1 || stats.Connections != 0 {
+		return fmt.Errorf("unexpected connection stats: %+v", stats)
+	}
+	if stats.BytesRead != 5 || stats.BytesWritten != 5 {
+		return fmt.Errorf("read %d bytes, written %d bytes, expect 5", stats.BytesRead, stats.BytesWritten)
+	}
+	var w = httptest.NewRecorder()
+	StatsHandler(srv).ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	var body = w.Body.String()
+	for _, metric := range []string{
+		"# TYPE cnet_connections_accepted_total counter",
+		`cnet_read_bytes_total{network="tcp",addr="` + srv.LocalAddr() + `",loop="`,
+		"cnet_buffer_pool_gets_total ",
+	} {
+		if !strings.Contains(body, metric) {
+			return fmt.Errorf("metric %q not found in:\n%s", metric, body)
+		}
+	}
+	return nil
+}
+
+type bufferPrintfer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *bufferPrintfer) Printf(format string, args ...interface{}) {
+	b.mu.Lock()
+	fmt.Fprintf(&b.buf, format+"\n", args...)
+	b.mu.Unlock()
+}
+
+func (b *bufferPrintfer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func testLogger(addr string) error {
+	var (
+		out    = &bufferPrintfer{}
+		logger = NewPrintfLogger(out, LevelInfo)
+		srv    Server
+		err    error
+	)
+	logger.Debug("dropped")
+	logger.Warn("message", "fd", 3, "odd")
+	if s := out.String(); s != "[WARN] message fd=3 !BADKEY=odd\n" {
+		return fmt.Errorf("unexpected log output: %q", s)
+	}
+	if srv, err = StartTcpService(&echoCallback{}, addr, TcpOption{ReusePort: true, MultiCore: 1, Logger: logger}); err != nil {
+		return err
+	}
+	shutdown(srv)
+	if s := out.String(); !strings.Contains(s, "[INFO] event-loop started loop=0 addr="+srv.LocalAddr()) {
+		return fmt.Errorf("event-loop start is not logged: %q", s)
+	}
+	return nil
+}
+
+type rejectCallback struct {
+	echoCallback
+	rejected chan RejectReason
+}
+
+func (rc *rejectCallback) OnConnRejected(addr string, reason RejectReason) {
+	rc.rejected <- reason
+}
+
+// 第一个连接正常，第二个连接被拒绝，关闭第一个连接后除速率限制外可以重新连接
+func testTcpLimit(addr string, opt TcpOption, expect RejectReason) error {
+	var (
+		srv    Server
+		c1, c2 net.Conn
+		cb     = &rejectCallback{rejected: make(chan RejectReason, 1)}
+		echo   = func(c net.Conn) error {
+			_ = c.SetDeadline(time.Now().Add(time.Second))
+			if _, err := c.Write([]byte("ping")); err != nil {
+				return err
+			}
+			_, err := io.ReadFull(c, make([]byte, 4))
+			return err
+		}
+		err error
+	)
+	opt.RejectMessage = []byte("busy")
+	if srv, err = StartTcpService(cb, addr, opt); err != nil {
+		return err
+	}
+	defer shutdown(srv)
+	if c1, err = net.Dial("tcp", "127.0.0.1"+addr); err != nil {
+		return err
+	}
+	if err = echo(c1); err != nil {
+		return err
+	}
+	if c2, err = net.Dial("tcp", "127.0.0.1"+addr); err != nil {
+		return err
+	}
+	defer c2.Close()
+	_ = c2.SetReadDeadline(time.Now().Add(time.Second))
+	if rcv, err := ioutil.ReadAll(c2); err != nil || string(rcv) != "busy" {
+		return fmt.Errorf("rejected connection receive %q, %v", rcv, err)
+	}
+	select {
+	case reason := <-cb.rejected:
+		if reason != expect {
+			return fmt.Errorf("reject reason %v, expect %v", reason, expect)
+		}
+	case <-time.After(time.Second):
+		return fmt.Errorf("OnConnRejected is not called")
+	}
+	c1.Close()
+	if expect == RejectRateLimited {
+		return nil
+	}
+	for i := 0; i < 100 && srv.Stats().Connections != 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if c1, err = net.Dial("tcp", "127.0.0.1"+addr); err != nil {
+		return err
+	}
+	defer c1.Close()
+	return echo(c1)
+}
+
+type aclUdpCallback struct {
+	serverCallback
+	rejected chan RejectReason
+}
+
+func (ac *aclUdpCallback) OnConnRejected(addr string, reason RejectReason) {
+	ac.rejected <- reason
+}
+
+func testAccessControl(addr string) error {
+	var (
+		tcpSrv, udpSrv Server
+		c              net.Conn
+		rcv            = make([]byte, 64)
+		tcpCb          = &rejectCallback{rejected: make(chan RejectReason, 1)}
+		udpCb          = &aclUdpCallback{rejected: make(chan RejectReason, 1)}
+		acl            *AccessControl
+		err            error
+	)
+	if _, err = NewAccessControl([]string{"10.0.0.0/33"}, nil); err == nil {
+		return fmt.Errorf("invalid CIDR is accepted")
+	}
+	if acl, err = NewAccessControl([]string{"10.0.0.0/8", "::1"}, nil); err != nil {
+		return err
+	}
+	if !acl.Allowed(net.ParseIP("10.1.2.3")) || acl.Allowed(net.ParseIP("127.0.0.1")) {
+		return fmt.Errorf("unexpected allow list matching")
+	}
+	if tcpSrv, err = StartTcpService(tcpCb, addr, TcpOption{AccessControl: acl}); err != nil {
+		return err
+	}
+	defer shutdown(tcpSrv)
+	if udpSrv, err = StartUdpService(udpCb, addr, UdpOption{AccessControl: acl}); err != nil {
+		return err
+	}
+	defer shutdown(udpSrv)
+
+	// 127.0.0.1不在allow列表中
+	if c, err = net.Dial("tcp", "127.0.0.1"+addr); err != nil {
+		return err
+	}
+	_ = c.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err = c.Read(rcv); err != io.EOF {
+		c.Close()
+		return fmt.Errorf("denied connection read: %v, expect EOF", err)
+	}
+	c.Close()
+	if reason := <-tcpCb.rejected; reason != RejectAccessDenied {
+		return fmt.Errorf("reject reason %v, expect %v", reason, RejectAccessDenied)
+	}
+	if c, err = net.Dial("udp", "127.0.0.1"+addr); err != nil {
+		return err
+	}
+	defer c.Close()
+	if _, err = c.Write([]byte("ping")); err != nil {
+		return err
+	}
+	select {
+	case <-udpCb.rejected:
+	case <-time.After(time.Second):
+		return fmt.Errorf("denied packet is not rejected")
+	}
+
+	// 运行时替换规则
+	if err = acl.Update(nil, []string{"192.168.0.0/16"}); err != nil {
+		return err
+	}
+	_ = c.SetDeadline(time.Now().Add(time.Second))
+	if _, err = c.Write([]byte("ping")); err != nil {
+		return err
+	}
+	if _, err = c.Read(rcv); err != nil {
+		return err
+	}
+	var tc net.Conn
+	if tc, err = net.Dial("tcp", "127.0.0.1"+addr); err != nil {
+		return err
+	}
+	defer tc.Close()
+	_ = tc.SetDeadline(time.Now().Add(time.Second))
+	if _, err = tc.Write([]byte("ping")); err != nil {
+		return err
+	}
+	_, err = io.ReadFull(tc, make([]byte, 4))
+	return err
+}
+
+type lastLoop struct{}
+
+func (lastLoop) Select(remote net.Addr, loops []LoopInfo) int {
+	return len(loops) - 1
+}
+
+// 依次建立4个连接，检查各event-loop的连接数，expect为nil时要求全部连接在同一event-loop
+// 4个event-loop，建立n个连接，wait为false时连续建立连接，不等待前一个连接注册完成
+func testLoadBalancing(addr string, opt TcpOption, n int, wait bool, expect []int64) error {
+	var (
+		srv Server
+		err error
+	)
+	opt.MultiCore = 4
+	if srv, err = StartTcpService(&echoCallback{}, addr, opt); err != nil {
+		return err
+	}
+	defer shutdown(srv)
+	for i := 0; i < n; i++ {
+		var c net.Conn
+		if c, err = net.Dial("tcp", "127.0.0.1"+addr); err != nil {
+			return err
+		}
+		defer c.Close()
+		for j := 0; wait && j < 100 && srv.Stats().Connections != int64(i+1); j++ {
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+	for j := 0; j < 100 && srv.Stats().Connections != int64(n); j++ {
+		time.Sleep(5 * time.Millisecond)
+	}
+	var conns []int64
+	for _, l := range srv.Stats().Loops {
+		conns = append(conns, l.Connections)
+	}
+	if expect == nil {
+		for _, k := range conns {
+			if k != 0 && k != int64(n) {
+				return fmt.Errorf("connections of loops: %v, expect all in one loop", conns)
+			}
+		}
+		return nil
+	}
+	if fmt.Sprint(conns) != fmt.Sprint(expect) {
+		return fmt.Errorf("connections of loops: %v, expect %v", conns, expect)
+	}
+	return nil
+}
+
+type listenerCallback struct {
+	EventServer
+}
+
+// 回复连接所属的监听名称
+func (lc *listenerCallback) ConnHandler(c Conn) (out []byte, op Operation) {
+	var n, rcv = c.Read()
+	out = append([]byte(c.Listener()+":"), rcv...)
+	c.ShiftN(n)
+	return
+}
+
+func testMultiService(opt TcpOption) error {
+	var (
+		srv  Server
+		cert tls.Certificate
+		dir  string
+		err  error
+	)
+	if cert, err = testCertificate(); err != nil {
+		return err
+	}
+	if dir, err = ioutil.TempDir("", "cnet"); err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	var (
+		path  = filepath.Join(dir, "multi.sock")
+		specs = []ListenerSpec{
+			{Name: "plain", Network: Tcp, Addr: ":8000"},
+			{Name: "tls", Network: Tcp, Addr: ":8001", TLSConfig: &tls.Config{Certificates: []tls.Certificate{cert}}},
+			{Network: Unix, Addr: path},
+		}
+		dials = []func() (net.Conn, error){
+			func() (net.Conn, error) { return net.Dial("tcp", "127.0.0.1:8000") },
+			func() (net.Conn, error) {
+				return tls.Dial("tcp", "127.0.0.1:8001", &tls.Config{InsecureSkipVerify: true})
+			},
+			func() (net.Conn, error) { return net.Dial("unix", path) },
+		}
+		expect = []string{"plain:ping", "tls:ping", path + ":ping"}
+	)
+	if _, err = StartMultiService(&listenerCallback{}, nil, opt); err != ErrNoListener {
+		return fmt.Errorf("start without listener: %v, expect ErrNoListener", err)
+	}
+	if srv, err = StartMultiService(&listenerCallback{}, specs, opt); err != nil {
+		return err
+	}
+	defer shutdown(srv)
+	for i, dial := range dials {
+		var c net.Conn
+		if c, err = dial(); err != nil {
+			return err
+		}
+		_ = c.SetDeadline(time.Now().Add(time.Second))
+		var rcv = make([]byte, len(expect[i]))
+		if _, err = c.Write([]byte("ping")); err == nil {
+			_, err = io.ReadFull(c, rcv)
+		}
+		c.Close()
+		if err != nil {
+			return err
+		}
+		if string(rcv) != expect[i] {
+			return fmt.Errorf("receive %q, expect %q", rcv, expect[i])
+		}
+	}
+	return nil
+}
+
+const envUpgradeHelper = "CNET_TEST_UPGRADE_HELPER"
+
+var upgradeSock = filepath.Join(os.TempDir(), "cnet-upgrade.sock")
+
+// TestUpgradeHelper 作为Upgrade启动的新进程运行，继承:8000与upgradeSock
+func TestUpgradeHelper(t *testing.T) {
+	if os.Getenv(envUpgradeHelper) == "" {
+		t.Skip("run by upgrade test")
+	}
+	var srv, err = StartMultiService(&upgradeCallback{tag: "new"}, upgradeSpecs(), TcpOption{MultiCore: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Wait()
+}
+
+func upgradeSpecs() []ListenerSpec {
+	return []ListenerSpec{
+		{Network: Tcp, Addr: ":8000"},
+		{Network: Unix, Addr: upgradeSock},
+	}
+}
+
+type upgradeCallback struct {
+	EventServer
+	tag string
+}
+
+// 回复进程标记，收到quit时关闭服务
+func (uc *upgradeCallback) ConnHandler(c Conn) (out []byte, op Operation) {
+	var n, rcv = c.Read()
+	if string(rcv) == "quit" {
+		op = Shutdown
+	} else {
+		out = append([]byte(uc.tag+":"), rcv...)
+	}
+	c.ShiftN(n)
+	return
+}
+
+func upgradeRoundTrip(network, addr, msg string) (string, error) {
+	var c, err = net.Dial(network, addr)
+	if err != nil {
+		return "", err
+	}
+	defer c.Close()
+	_ = c.SetDeadline(time.Now().Add(time.Second))
+	if _, err = c.Write([]byte(msg)); err != nil {
+		return "", err
+	}
+	var rcv = make([]byte, 64)
+	n, err := c.Read(rcv)
+	return string(rcv[:n]), err
+}
+
+func testUpgrade() error {
+	var (
+		srv Server
+		rcv string
+		err error
+	)
+	if srv, err = StartMultiService(&upgradeCallback{tag: "old"}, upgradeSpecs(), TcpOption{MultiCore: 2}); err != nil {
+		return err
+	}
+	defer shutdown(srv)
+	if rcv, err = upgradeRoundTrip("tcp", "127.0.0.1:8000", "ping"); err != nil || rcv != "old:ping" {
+		return fmt.Errorf("before upgrade receive %q, %v", rcv, err)
+	}
+	var command = upgradeCommand
+	upgradeCommand = func() (string, []string, error) {
+		var path, err = os.Executable()
+		return path, []string{os.Args[0], "-test.run=^TestUpgradeHelper$"}, err
+	}
+	_ = os.Setenv(envUpgradeHelper, "1")
+	var ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+	err = srv.Upgrade(ctx)
+	cancel()
+	upgradeCommand = command
+	_ = os.Unsetenv(envUpgradeHelper)
+	if err != nil {
+		return err
+	}
+	// 当前服务已关闭，连接由新进程处理
+	srv.Wait()
+	if rcv, err = upgradeRoundTrip("tcp", "127.0.0.1:8000", "ping"); err != nil || rcv != "new:ping" {
+		return fmt.Errorf("after upgrade receive %q, %v", rcv, err)
+	}
+	if rcv, err = upgradeRoundTrip("unix", upgradeSock, "ping"); err != nil || rcv != "new:ping" {
+		return fmt.Errorf("after upgrade unix receive %q, %v", rcv, err)
+	}
+	// 关闭新进程并等待端口释放
+	_, _ = upgradeRoundTrip("tcp", "127.0.0.1:8000", "quit")
+	for i := 0; i < 100; i++ {
+		var c net.Conn
+		if c, err = net.Dial("tcp", "127.0.0.1:8000"); err != nil {
+			_ = os.Remove(upgradeSock)
+			return nil
+		}
+		c.Close()
+		time.Sleep(20 * time.Millisecond)
+	}
+	return fmt.Errorf("upgraded process is still running")
+}
+
+const envSystemdHelper = "CNET_TEST_SYSTEMD_HELPER"
+
+// TestSystemdHelper 作为被systemd socket activation启动的进程运行，使用名为web的socket
+func TestSystemdHelper(t *testing.T) {
+	if os.Getenv(envSystemdHelper) == "" {
+		t.Skip("run by systemd test")
+	}
+	// 启动前无法得知pid，由进程自己设置LISTEN_PID
+	_ = os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	var c = Cnet{
+		Network:       Tcp,
+		Addr:          ":8002",
+		MultiCore:     2,
+		Callback:      &upgradeCallback{tag: "activated"},
+		SystemdSocket: "web",
+		SystemdNotify: true,
+	}
+	var srv, err = c.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Wait()
+}
+
+func testSystemd() error {
+	var (
+		dir    string
+		notify *net.UnixConn
+		other  net.Listener
+		web    net.Listener
+		files  [2]*os.File
+		err    error
+	)
+	if dir, err = ioutil.TempDir("", "cnet"); err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	// 代替systemd接收sd_notify
+	var path = filepath.Join(dir, "notify.sock")
+	if notify, err = net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"}); err != nil {
+		return err
+	}
+	defer notify.Close()
+	if other, err = net.Listen("tcp", ":8001"); err != nil {
+		return err
+	}
+	defer other.Close()
+	if web, err = net.Listen("tcp", ":8000"); err != nil {
+		return err
+	}
+	defer web.Close()
+	for i, ln := range []net.Listener{other, web} {
+		if files[i], err = ln.(*net.TCPListener).File(); err != nil {
+			return err
+		}
+		defer files[i].Close()
+	}
+	var cmd = exec.Command(os.Args[0], "-test.run=^TestSystemdHelper$")
+	cmd.ExtraFiles = files[:]
+	cmd.Env = append(os.Environ(), envSystemdHelper+"=1", "LISTEN_FDS=2", "LISTEN_FDNAMES=other:web", "NOTIFY_SOCKET="+path)
+	if err = cmd.Start(); err != nil {
+		return err
+	}
+	defer cmd.Wait()
+	var expectNotify = func(state string) error {
+		var buf = make([]byte, 64)
+		_ = notify.SetReadDeadline(time.Now().Add(5 * time.Second))
+		var n, err = notify.Read(buf)
+		if err != nil {
+			return err
+		}
+		if string(buf[:n]) != state {
+			return fmt.Errorf("notify %q, expect %q", buf[:n], state)
+		}
+		return nil
+	}
+	if err = expectNotify("READY=1"); err != nil {
+		_ = cmd.Process.Kill()
+		return err
+	}
+	var rcv string
+	if rcv, err = upgradeRoundTrip("tcp", "127.0.0.1:8000", "ping"); err != nil || rcv != "activated:ping" {
+		_ = cmd.Process.Kill()
+		return fmt.Errorf("receive %q, %v", rcv, err)
+	}
+	if c, err := net.Dial("tcp", "127.0.0.1:8002"); err == nil {
+		c.Close()
+		_ = cmd.Process.Kill()
+		return fmt.Errorf("listened on addr instead of the activated socket")
+	}
+	_, _ = upgradeRoundTrip("tcp", "127.0.0.1:8000", "quit")
+	return expectNotify("STOPPING=1")
+}
+
+type workerCallback struct {
+	EventServer
+	running, max int64
+}
+
+// 模拟阻塞的ConnHandler，记录同时执行的最大数量
+func (wc *workerCallback) ConnHandler(c Conn) (out []byte, op Operation) {
+	var running = atomic.AddInt64(&wc.running, 1)
+	defer atomic.AddInt64(&wc.running, -1)
+	for {
+		var max = atomic.LoadInt64(&wc.max)
+		if running <= max || atomic.CompareAndSwapInt64(&wc.max, max, running) {
+			break
+		}
+	}
+	time.Sleep(10 * time.Millisecond)
+	if out = c.ReadFrame(); out == nil {
+		var n, rcv = c.Read()
+		out = append(out, rcv...)
+		c.ShiftN(n)
+	}
+	return
+}
+
+func testWorkerPool(codec ICodec, core int) error {
+	const (
+		workers = 2
+		conns   = 8
+	)
+	var (
+		cb       = &workerCallback{}
+		srv, err = StartTcpService(cb, ":8000", TcpOption{MultiCore: core, Codec: codec, WorkerPool: workers})
+		wg       sync.WaitGroup
+		errs     = make(chan error, conns)
+	)
+	if err != nil {
+		return err
+	}
+	defer shutdown(srv)
+	for i := 0; i < conns; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			var c, err = net.Dial("tcp", "127.0.0.1:8000")
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer c.Close()
+			_ = c.SetDeadline(time.Now().Add(5 * time.Second))
+			var (
+				r      = bufio.NewReader(c)
+				expect []string
+			)
+			for j := 0; j < 3; j++ {
+				var line = fmt.Sprintf("%d-%d\n", i, j)
+				expect = append(expect, line)
+				// 有codec时一次写入多帧，回复需保持顺序
+				if codec != nil {
+					if _, err = c.Write([]byte(line)); err != nil {
+						errs <- err
+						return
+					}
+					continue
+				}
+				var rcv string
+				if _, err = c.Write([]byte(line)); err == nil {
+					rcv, err = r.ReadString('\n')
+				}
+				if err != nil || rcv != line {
+					errs <- fmt.Errorf("receive %q, %v, expect %q", rcv, err, line)
+					return
+				}
+			}
+			if codec == nil {
+				return
+			}
+			for _, line := range expect {
+				var rcv, err = r.ReadString('\n')
+				if err != nil || rcv != line {
+					errs <- fmt.Errorf("receive %q, %v, expect %q", rcv, err, line)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err = range errs {
+		return err
+	}
+	if max := atomic.LoadInt64(&cb.max); max > workers {
+		return fmt.Errorf("%d handlers ran at the same time, expect at most %d", max, workers)
+	}
+	return nil
+}
+
+type resetCallback struct {
+	EventServer
+	mu      sync.Mutex
+	events  []string
+	started chan struct{}
+	closed  chan error
+	panics  int64
+}
+
+func (rc *resetCallback) record(event string) {
+	rc.mu.Lock()
+	rc.events = append(rc.events, event)
+	rc.mu.Unlock()
+}
+
+// ConnHandler执行期间到期
+func (rc *resetCallback) OnConnOpened(c Conn) (out []byte, op Operation) {
+	c.AfterFunc(100*time.Millisecond, func(c Conn) (out []byte, op Operation) {
+		rc.record("timer")
+		return
+	})
+	return
+}
+
+// 阻塞期间唤醒连接，且连接被对端重置
+func (rc *resetCallback) ConnHandler(c Conn) (out []byte, op Operation) {
+	rc.record("handler")
+	_ = c.Wake()
+	rc.started <- struct{}{}
+	time.Sleep(300 * time.Millisecond)
+	var n, rcv = c.Read()
+	rc.record("read " + string(rcv))
+	c.ShiftN(n)
+	return
+}
+
+func (rc *resetCallback) OnWakenHandler(c Conn) (out []byte, op Operation) {
+	rc.record("wake")
+	return
+}
+
+func (rc *resetCallback) OnConnClosed(c Conn, err error) (op Operation) {
+	rc.record("closed")
+	rc.closed <- err
+	return
+}
+
+func (rc *resetCallback) OnPanic(c Conn, v interface{}, stack []byte) {
+	atomic.AddInt64(&rc.panics, 1)
+}
+
+// ConnHandler在worker中执行时连接被RST关闭，Wake、定时任务与OnConnClosed在ConnHandler返回后按顺序回调
+func testWorkerPoolReset() error {
+	var (
+		cb = &resetCallback{
+			started: make(chan struct{}, 1),
+			closed:  make(chan error, 1),
+		}
+		srv, err = StartTcpService(cb, ":8000", TcpOption{MultiCore: 1, WorkerPool: 1})
+		c        net.Conn
+	)
+	if err != nil {
+		return err
+	}
+	defer shutdown(srv)
+	if c, err = net.Dial("tcp", "127.0.0.1:8000"); err != nil {
+		return err
+	}
+	if _, err = c.Write([]byte{'x'}); err != nil {
+		_ = c.Close()
+		return err
+	}
+	select {
+	case <-cb.started:
+	case <-time.After(3 * time.Second):
+		_ = c.Close()
+		return fmt.Errorf("ConnHandler is not called")
+	}
+	// 定时任务到期后重置连接
+	time.Sleep(150 * time.Millisecond)
+	_ = c.(*net.TCPConn).SetLinger(0)
+	_ = c.Close()
+	select {
+	case <-cb.closed:
+	case <-time.After(3 * time.Second):
+		return fmt.Errorf("OnConnClosed is not called")
+	}
+	cb.mu.Lock()
+	var events = strings.Join(cb.events, ", ")
+	cb.mu.Unlock()
+	if expect := "handler, read x, wake, timer, closed"; events != expect {
+		return fmt.Errorf("callbacks are called in order %q, expect %q", events, expect)
+	}
+	if n := atomic.LoadInt64(&cb.panics); n != 0 {
+		return fmt.Errorf("%d panics after connection reset", n)
+	}
+	return nil
+}
+
+type workingShutdownCallback struct {
+	EventServer
+	srv     Server
+	mu      sync.Mutex
+	events  []string
+	conn    chan Conn
+	release chan struct{}
+}
+
+func (wc *workingShutdownCallback) record(event string) {
+	wc.mu.Lock()
+	wc.events = append(wc.events, event)
+	wc.mu.Unlock()
+}
+
+func (wc *workingShutdownCallback) OnInitComplete(srv Server) (op Operation) {
+	wc.srv = srv
+	return
+}
+
+// 服务关闭期间阻塞，worker中Wait不等待关闭完成
+func (wc *workingShutdownCallback) ConnHandler(c Conn) (out []byte, op Operation) {
+	wc.record("handler")
+	wc.conn <- c
+	<-wc.release
+	wc.srv.Wait()
+	wc.record("wait")
+	var n, _ = c.Read()
+	c.ShiftN(n)
+	return
+}
+
+func (wc *workingShutdownCallback) OnConnClosed(c Conn, err error) (op Operation) {
+	wc.record("closed")
+	return
+}
+
+// ConnHandler在worker中执行时关闭服务，等待ConnHandler返回后关闭连接与event-loop，之后Wake返回错误
+func testWorkerPoolShutdown() error {
+	var (
+		cb = &workingShutdownCallback{
+			conn:    make(chan Conn, 1),
+			release: make(chan struct{}),
+		}
+		srv, err = StartTcpService(cb, ":8000", TcpOption{MultiCore: 1, WorkerPool: 1})
+		c        net.Conn
+		sc       Conn
+		done     = make(chan struct{})
+	)
+	if err != nil {
+		return err
+	}
+	if c, err = net.Dial("tcp", "127.0.0.1:8000"); err != nil {
+		shutdown(srv)
+		return err
+	}
+	defer c.Close()
+	if _, err = c.Write([]byte{'x'}); err != nil {
+		shutdown(srv)
+		return err
+	}
+	select {
+	case sc = <-cb.conn:
+	case <-time.After(3 * time.Second):
+		shutdown(srv)
+		return fmt.Errorf("ConnHandler is not called")
+	}
+	go func() {
+		shutdown(srv)
+		close(done)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	close(cb.release)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		return fmt.Errorf("Shutdown is not returned")
+	}
+	cb.mu.Lock()
+	var events = strings.Join(cb.events, ", ")
+	cb.mu.Unlock()
+	if expect := "handler, wait, closed"; events != expect {
+		return fmt.Errorf("callbacks are called in order %q, expect %q", events, expect)
+	}
+	if err = sc.Wake(); err == nil {
+		return fmt.Errorf("Wake after shutdown returns no error")
+	}
+	return nil
+}
+
+type panicCallback struct {
+	EventServer
+	panics chan error
+}
+
+// 收到panic时在回调中panic，收到wake时在OnWakenHandler中panic，其他数据原样返回
+func (pc *panicCallback) ConnHandler(c Conn) (out []byte, op Operation) {
+	var n, rcv = c.Read()
+	switch string(rcv) {
+	case "panic":
+		panic("boom")
+	case "wake":
+		c.ShiftN(n)
+		_ = c.Wake()
+		return
+	}
+	out = append(out, rcv...)
+	c.ShiftN(n)
+	return
+}
+
+func (pc *panicCallback) OnWakenHandler(c Conn) (out []byte, op Operation) {
+	panic("wake boom")
+}
+
+func (pc *panicCallback) OnConnClosed(c Conn, err error) (op Operation) {
+	if err != nil && err != ErrCallbackPanic {
+		pc.panics <- fmt.Errorf("closed with %v, expect ErrCallbackPanic", err)
+	}
+	return
+}
+
+func (pc *panicCallback) OnPanic(c Conn, v interface{}, stack []byte) {
+	if c == nil || len(stack) == 0 {
+		pc.panics <- fmt.Errorf("panic %v without connection or stack", v)
+		return
+	}
+	pc.panics <- nil
+}
+
+type tickPanicCallback struct {
+	EventServer
+	ticks, panics int64
+}
+
+// 第二次回调时panic
+func (tc *tickPanicCallback) OnTick() (delay time.Duration, op Operation) {
+	if atomic.AddInt64(&tc.ticks, 1) == 2 {
+		panic("tick")
+	}
+	return 20 * time.Millisecond, None
+}
+
+func (tc *tickPanicCallback) OnPanic(c Conn, v interface{}, stack []byte) {
+	atomic.AddInt64(&tc.panics, 1)
+}
+
+// OnTick panic之后继续回调
+func testTickPanic() error {
+	var (
+		cb       = &tickPanicCallback{}
+		srv, err = StartTcpService(cb, ":8000", TcpOption{MultiCore: 1})
+	)
+	if err != nil {
+		return err
+	}
+	defer shutdown(srv)
+	time.Sleep(300 * time.Millisecond)
+	if n := atomic.LoadInt64(&cb.panics); n != 1 {
+		return fmt.Errorf("OnPanic is called %d times, expect 1", n)
+	}
+	if n := atomic.LoadInt64(&cb.ticks); n < 4 {
+		return fmt.Errorf("OnTick is called %d times after panic", n)
+	}
+	return nil
+}
+
+func testPanic(opt TcpOption) error {
+	var (
+		cb       = &panicCallback{panics: make(chan error, 4)}
+		srv, err = StartTcpService(cb, ":8000", opt)
+		alive    net.Conn
+	)
+	if err != nil {
+		return err
+	}
+	defer shutdown(srv)
+	if alive, err = net.Dial("tcp", "127.0.0.1:8000"); err != nil {
+		return err
+	}
+	defer alive.Close()
+	for _, msg := range []string{"panic", "wake"} {
+		var c net.Conn
+		if c, err = net.Dial("tcp", "127.0.0.1:8000"); err != nil {
+			return err
+		}
+		_ = c.SetDeadline(time.Now().Add(time.Second))
+		if _, err = c.Write([]byte(msg)); err != nil {
+			c.Close()
+			return err
+		}
+		// 只关闭panic的连接
+		_, err = c.Read(make([]byte, 16))
+		c.Close()
+		if err != io.EOF {
+			return fmt.Errorf("%s: read %v, expect EOF", msg, err)
+		}
+		select {
+		case err = <-cb.panics:
+			if err != nil {
+				return err
+			}
+		case <-time.After(time.Second):
+			return fmt.Errorf("%s: OnPanic is not called", msg)
+		}
+		_ = alive.SetDeadline(time.Now().Add(time.Second))
+		var rcv = make([]byte, 4)
+		if _, err = alive.Write([]byte("ping")); err == nil {
+			_, err = io.ReadFull(alive, rcv)
+		}
+		if err != nil || string(rcv) != "ping" {
+			return fmt.Errorf("%s: event-loop is not alive, receive %q, %v", msg, rcv, err)
+		}
+	}
+	return nil
+}
+
+// wrappedConn 返回入站缓冲区中数据跨越末尾的连接，内容为data
+func wrappedConn(data string) *conn {
+	var c = &conn{inBuf: buf.NewRingBuf(16)}
+	c.reader.c = c
+	c.inBuf.Write(make([]byte, 12))
+	c.inBuf.Shift(11)
+	c.inBuf.WriteString(data)
+	c.inBuf.Shift(1)
+	return c
+}
+
+func testBufferAccess() error {
+	var c = wrappedConn("0123456789")
+	if p := c.Peek(0); len(p) != 2 || string(p[0]) != "0123" || string(p[1]) != "456789" {
+		return fmt.Errorf("peek all %q", p)
+	}
+	if p := c.Peek(3); len(p) != 1 || string(p[0]) != "012" {
+		return fmt.Errorf("peek 3 %q", p)
+	}
+	if p := c.Peek(11); p != nil {
+		return fmt.Errorf("peek 11 %q, expect nil", p)
+	}
+	if b, err := c.ReadByte(); err != nil || b != '0' {
+		return fmt.Errorf("read byte %q, %v", b, err)
+	}
+	if n := c.Discard(1); n != 1 {
+		return fmt.Errorf("discard %d", n)
+	}
+	if b := c.Next(4); string(b) != "2345" {
+		return fmt.Errorf("next %q", b)
+	}
+	if b := c.Until('x'); b != nil || c.BufferLength() != 4 {
+		return fmt.Errorf("until missing delim %q, %d bytes left", b, c.BufferLength())
+	}
+	if b := c.Until('7'); string(b) != "67" {
+		return fmt.Errorf("until %q", b)
+	}
+	if b := c.Next(3); b != nil {
+		return fmt.Errorf("next 3 of 2 bytes %q, expect nil", b)
+	}
+	if n := c.Discard(10); n != 2 || c.BufferLength() != 0 {
+		return fmt.Errorf("discard %d, %d bytes left", n, c.BufferLength())
+	}
+	if _, err := c.ReadByte(); err != io.EOF {
+		return fmt.Errorf("read byte of empty buffer %v, expect EOF", err)
+	}
+	// 跨越末尾的数据复制到复用的缓冲区
+	c = wrappedConn("ab\ncd\nef")
+	if b := c.Until('\n'); string(b) != "ab\n" {
+		return fmt.Errorf("until %q", b)
+	}
+	if b := c.Until('\n'); string(b) != "cd\n" {
+		return fmt.Errorf("until across the end %q", b)
+	}
+	var w bytes.Buffer
+	if n, err := io.Copy(&w, c.Reader()); err != nil || n != 2 || w.String() != "ef" {
+		return fmt.Errorf("copy %d %q, %v", n, w.String(), err)
+	}
+	c = wrappedConn("0123456789")
+	if allocs := testing.AllocsPerRun(100, func() {
+		_ = c.Peek(0)
+		_ = c.Peek(6)
+		_ = c.Until('9')
+		c.inBuf.WriteString("0123456789")
+	}); allocs != 0 {
+		return fmt.Errorf("%v allocations per run, expect 0", allocs)
+	}
+	return nil
+}
+
+type httpCallback struct {
+	EventServer
+}
+
+// 使用bufio与net/http直接从入站缓冲区解析请求
+func (hc *httpCallback) ConnHandler(c Conn) (out []byte, op Operation) {
+	// 等待完整的请求头
+	var n, rcv = c.Read()
+	if !bytes.Contains(rcv, []byte("\r\n\r\n")) {
+		return
+	}
+	var req, err = http.ReadRequest(bufio.NewReaderSize(c.Reader(), 16))
+	if err != nil {
+		c.ShiftN(n)
+		return []byte(err.Error()), Close
+	}
+	return []byte(req.Method + " " + req.URL.Path + " " + req.Header.Get("X-Test")), None
+}
+
+func testHTTPReader() error {
+	var srv, err = StartTcpService(&httpCallback{}, ":8000", TcpOption{MultiCore: 1})
+	if err != nil {
+		return err
+	}
+	defer shutdown(srv)
+	var c net.Conn
+	if c, err = net.Dial("tcp", "127.0.0.1:8000"); err != nil {
+		return err
+	}
+	defer c.Close()
+	_ = c.SetDeadline(time.Now().Add(time.Second))
+	var (
+		expect = "GET /path cnet"
+		rcv    = make([]byte, len(expect))
+	)
+	if _, err = c.Write([]byte("GET /path HTTP/1.1\r\nHost: localhost\r\nX-Test: cnet\r\n\r\n")); err == nil {
+		_, err = io.ReadFull(c, rcv)
+	}
+	if err != nil || string(rcv) != expect {
+		return fmt.Errorf("receive %q, %v, expect %q", rcv, err, expect)
+	}
+	return nil
+}
+
+// 回显超过socket缓冲区大小的数据
+func testLargeEcho(addr string, opt TcpOption) error {
+	var srv, err = StartTcpService(&echoCallback{}, addr, opt)
+	if err != nil {
+		return err
+	}
+	defer shutdown(srv)
+	var c net.Conn
+	if c, err = net.Dial("tcp", "127.0.0.1"+addr); err != nil {
+		return err
+	}
+	defer c.Close()
+	_ = c.SetDeadline(time.Now().Add(5 * time.Second))
+	var (
+		data = bytes.Repeat([]byte("0123456789abcdef"), 1<<18) // 4MB
+		rcv  = make([]byte, len(data))
+		werr = make(chan error, 1)
+	)
+	go func() {
+		var _, err = c.Write(data)
+		werr <- err
+	}()
+	if _, err = io.ReadFull(c, rcv); err != nil {
+		return err
+	}
+	if err = <-werr; err != nil {
+		return err
+	}
+	if !bytes.Equal(rcv, data) {
+		return fmt.Errorf("echo data mismatch")
+	}
+	return nil
+}
+
+type halfCloseCallback struct {
+	EventServer
+}
+
+// 收到请求后回复4MB数据
+func (hc *halfCloseCallback) ConnHandler(c Conn) (out []byte, op Operation) {
+	c.ResetBuffer()
+	return bytes.Repeat([]byte("x"), 4<<20), None
+}
+
+// 对端关闭写方向后，待发送数据写完才关闭连接
+func testHalfClose(addr string, opt TcpOption) error {
+	var srv, err = StartTcpService(&halfCloseCallback{}, addr, opt)
+	if err != nil {
+		return err
+	}
+	defer shutdown(srv)
+	var c net.Conn
+	if c, err = net.Dial("tcp", "127.0.0.1"+addr); err != nil {
+		return err
+	}
+	defer c.Close()
+	_ = c.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err = c.Write([]byte("go")); err != nil {
+		return err
+	}
+	if err = c.(*net.TCPConn).CloseWrite(); err != nil {
+		return err
+	}
+	var rcv []byte
+	if rcv, err = ioutil.ReadAll(c); err != nil {
+		return err
+	}
+	if len(rcv) != 4<<20 {
+		return fmt.Errorf("received %d bytes before close, expect %d", len(rcv), 4<<20)
+	}
+	return nil
+}
+
+// BenchmarkThroughput 本地回环的回显吞吐量，比较水平触发与边缘触发
+func BenchmarkThroughput(b *testing.B) {
+	for _, bc := range []struct {
+		name string
+		opt  TcpOption
+	}{
+		{"level-triggered", TcpOption{MultiCore: 1}},
+		{"edge-triggered", TcpOption{MultiCore: 1, EdgeTriggered: true}},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			var srv, err = StartTcpService(&echoCallback{}, ":8000", bc.opt)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer shutdown(srv)
+			var c net.Conn
+			if c, err = net.Dial("tcp", "127.0.0.1:8000"); err != nil {
+				b.Fatal(err)
+			}
+			defer c.Close()
+			var (
+				data = make([]byte, 1<<20)
+				rcv  = make([]byte, len(data))
+				werr = make(chan error, 1)
+			)
+			b.SetBytes(int64(len(data)))
+			b.ResetTimer()
+			go func() {
+				for i := 0; i < b.N; i++ {
+					if _, err := c.Write(data); err != nil {
+						werr <- err
+						return
+					}
+				}
+				werr <- nil
+			}()
+			for i := 0; i < b.N; i++ {
+				if _, err = io.ReadFull(c, rcv); err != nil {
+					b.Fatal(err)
+				}
+			}
+			if err = <-werr; err != nil {
+				b.Fatal(err)
+			}
+		})
+	}
 }
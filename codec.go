@@ -0,0 +1,304 @@
+package cnet
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// ICodec 对tcp连接的数据进行编解码
+type ICodec interface {
+	// Encode 编码回调返回的数据后写入连接
+	Encode(c Conn, msg []byte) ([]byte, error)
+	// Decode 从入站缓冲区中解出一个完整的帧，数据不足时返回nil, nil，返回错误时关闭连接
+	Decode(c Conn) ([]byte, error)
+}
+
+// DefaultMaxFrameLength 未设置MaxFrameLength时帧长度的上限
+const DefaultMaxFrameLength = 8 << 20
+
+// maxFrameLength 返回帧长度上限，小于等于0时为DefaultMaxFrameLength
+func maxFrameLength(n int) int {
+	if n <= 0 {
+		return DefaultMaxFrameLength
+	}
+	return n
+}
+
+// LineBasedFrameCodec 以'\n'或"\r\n"分隔帧，编码时追加'\n'
+type LineBasedFrameCodec struct {
+	// 不含分隔符的帧长度上限，超过时关闭连接，为0时使用DefaultMaxFrameLength
+	MaxFrameLength int
+}
+
+// Encode 返回新分配的切片，不修改msg的底层数组
+func (codec *LineBasedFrameCodec) Encode(c Conn, msg []byte) ([]byte, error) {
+	var out = make([]byte, len(msg)+1)
+	copy(out, msg)
+	out[len(msg)] = '\n'
+	return out, nil
+}
+
+func (codec *LineBasedFrameCodec) Decode(c Conn) ([]byte, error) {
+	var (
+		n, buf = c.Read()
+		idx    = bytes.IndexByte(buf, '\n')
+		max    = maxFrameLength(codec.MaxFrameLength)
+	)
+	// 允许"\r\n"中的'\r'
+	if idx > max+1 || idx == -1 && n > max+1 {
+		return nil, ErrFrameTooLong
+	}
+	if n == 0 || idx == -1 {
+		return nil, nil
+	}
+	c.ShiftN(idx + 1)
+	if idx > 0 && buf[idx-1] == '\r' {
+		idx--
+	}
+	if idx > max {
+		return nil, ErrFrameTooLong
+	}
+	return buf[:idx], nil
+}
+
+// DelimiterBasedFrameCodec 以指定的分隔符分隔帧，编码时追加分隔符
+type DelimiterBasedFrameCodec struct {
+	delimiter      []byte
+	maxFrameLength int
+}
+
+// NewDelimiterBasedFrameCodec maxFrameLength为不含分隔符的帧长度上限，超过时关闭连接，为0时使用DefaultMaxFrameLength
+// delimiter为空时返回ErrEmptyDelimiter，maxFrameLength为负数时返回ErrInvalidCodecConfig
+func NewDelimiterBasedFrameCodec(delimiter []byte, maxFrameLength int) (*DelimiterBasedFrameCodec, error) {
+	if len(delimiter) == 0 {
+		return nil, ErrEmptyDelimiter
+	}
+	if maxFrameLength < 0 {
+		return nil, ErrInvalidCodecConfig
+	}
+	return &DelimiterBasedFrameCodec{
+		delimiter:      append([]byte(nil), delimiter...),
+		maxFrameLength: maxFrameLength,
+	}, nil
+}
+
+// Encode 返回新分配的切片，不修改msg的底层数组
+func (codec *DelimiterBasedFrameCodec) Encode(c Conn, msg []byte) ([]byte, error) {
+	var out = make([]byte, len(msg)+len(codec.delimiter))
+	copy(out[copy(out, msg):], codec.delimiter)
+	return out, nil
+}
+
+func (codec *DelimiterBasedFrameCodec) Decode(c Conn) ([]byte, error) {
+	var (
+		n, buf = c.Read()
+		idx    = bytes.Index(buf, codec.delimiter)
+		max    = maxFrameLength(codec.maxFrameLength)
+	)
+	// 分隔符可能只收到一部分
+	if idx > max || idx == -1 && n >= max+len(codec.delimiter) {
+		return nil, ErrFrameTooLong
+	}
+	if n == 0 || idx == -1 {
+		return nil, nil
+	}
+	c.ShiftN(idx + len(codec.delimiter))
+	return buf[:idx], nil
+}
+
+// FixedLengthFrameCodec 固定长度的帧，编码时数据长度必须为帧长度的整数倍
+type FixedLengthFrameCodec struct {
+	frameLength int
+}
+
+// NewFixedLengthFrameCodec frameLength小于等于0时返回ErrInvalidFixedLength
+func NewFixedLengthFrameCodec(frameLength int) (*FixedLengthFrameCodec, error) {
+	if frameLength <= 0 {
+		return nil, ErrInvalidFixedLength
+	}
+	return &FixedLengthFrameCodec{frameLength: frameLength}, nil
+}
+
+func (codec *FixedLengthFrameCodec) Encode(c Conn, msg []byte) ([]byte, error) {
+	if len(msg)%codec.frameLength != 0 {
+		return nil, ErrInvalidFixedLength
+	}
+	return msg, nil
+}
+
+func (codec *FixedLengthFrameCodec) Decode(c Conn) ([]byte, error) {
+	var size, buf = c.ReadN(codec.frameLength)
+	if size == 0 {
+		return nil, nil
+	}
+	c.ShiftN(size)
+	return buf, nil
+}
+
+// EncoderConfig 长度字段编码配置
+type EncoderConfig struct {
+	// 长度字段的字节序，默认为大端
+	ByteOrder binary.ByteOrder
+	// 长度字段的字节数，支持1, 2, 3, 4, 8
+	LengthFieldLength int
+	// 长度字段值的修正值
+	LengthAdjustment int
+	// 长度字段值是否包含长度字段本身的长度
+	LengthIncludesLengthFieldLength bool
+}
+
+// DecoderConfig 长度字段解码配置，帧长度 = 长度字段值 + LengthAdjustment + LengthFieldOffset + LengthFieldLength
+type DecoderConfig struct {
+	// 长度字段的字节序，默认为大端
+	ByteOrder binary.ByteOrder
+	// 长度字段的偏移量
+	LengthFieldOffset int
+	// 长度字段的字节数，支持1, 2, 3, 4, 8
+	LengthFieldLength int
+	// 长度字段值的修正值
+	LengthAdjustment int
+	// 解出的帧需要跳过的头部字节数
+	InitialBytesToStrip int
+	// 包含头部的帧长度上限，超过时关闭连接，为0时使用DefaultMaxFrameLength
+	MaxFrameLength int
+}
+
+// LengthFieldBasedFrameCodec 基于长度字段的帧
+type LengthFieldBasedFrameCodec struct {
+	encoderConfig EncoderConfig
+	decoderConfig DecoderConfig
+}
+
+// NewLengthFieldBasedFrameCodec LengthFieldLength不是1, 2, 3, 4, 8时返回ErrUnsupportedLength，
+// LengthFieldOffset、InitialBytesToStrip或MaxFrameLength为负数时返回ErrInvalidCodecConfig
+func NewLengthFieldBasedFrameCodec(encoderConfig EncoderConfig, decoderConfig DecoderConfig) (*LengthFieldBasedFrameCodec, error) {
+	if !validLengthFieldLength(encoderConfig.LengthFieldLength) || !validLengthFieldLength(decoderConfig.LengthFieldLength) {
+		return nil, ErrUnsupportedLength
+	}
+	if decoderConfig.LengthFieldOffset < 0 || decoderConfig.InitialBytesToStrip < 0 || decoderConfig.MaxFrameLength < 0 {
+		return nil, ErrInvalidCodecConfig
+	}
+	if encoderConfig.ByteOrder == nil {
+		encoderConfig.ByteOrder = binary.BigEndian
+	}
+	if decoderConfig.ByteOrder == nil {
+		decoderConfig.ByteOrder = binary.BigEndian
+	}
+	decoderConfig.MaxFrameLength = maxFrameLength(decoderConfig.MaxFrameLength)
+	return &LengthFieldBasedFrameCodec{encoderConfig: encoderConfig, decoderConfig: decoderConfig}, nil
+}
+
+func validLengthFieldLength(n int) bool {
+	switch n {
+	case 1, 2, 3, 4, 8:
+		return true
+	}
+	return false
+}
+
+func (codec *LengthFieldBasedFrameCodec) Encode(c Conn, msg []byte) ([]byte, error) {
+	var (
+		cfg    = &codec.encoderConfig
+		length = len(msg) + cfg.LengthAdjustment
+	)
+	if cfg.LengthIncludesLengthFieldLength {
+		length += cfg.LengthFieldLength
+	}
+	if length < 0 {
+		return nil, ErrTooLessLength
+	}
+	var out = make([]byte, cfg.LengthFieldLength, cfg.LengthFieldLength+len(msg))
+	switch cfg.LengthFieldLength {
+	case 1:
+		if length >= 1<<8 {
+			return nil, ErrTooLongLength
+		}
+		out[0] = byte(length)
+	case 2:
+		if length >= 1<<16 {
+			return nil, ErrTooLongLength
+		}
+		cfg.ByteOrder.PutUint16(out, uint16(length))
+	case 3:
+		if length >= 1<<24 {
+			return nil, ErrTooLongLength
+		}
+		putUint24(cfg.ByteOrder, out, uint64(length))
+	case 4:
+		if uint64(length) >= 1<<32 {
+			return nil, ErrTooLongLength
+		}
+		cfg.ByteOrder.PutUint32(out, uint32(length))
+	case 8:
+		cfg.ByteOrder.PutUint64(out, uint64(length))
+	default:
+		return nil, ErrUnsupportedLength
+	}
+	return append(out, msg...), nil
+}
+
+func (codec *LengthFieldBasedFrameCodec) Decode(c Conn) ([]byte, error) {
+	var (
+		cfg       = &codec.decoderConfig
+		headerLen = cfg.LengthFieldOffset + cfg.LengthFieldLength
+		size, buf = c.ReadN(headerLen)
+		length    uint64
+	)
+	if size == 0 {
+		return nil, nil
+	}
+	var field = buf[cfg.LengthFieldOffset:headerLen]
+	switch cfg.LengthFieldLength {
+	case 1:
+		length = uint64(field[0])
+	case 2:
+		length = uint64(cfg.ByteOrder.Uint16(field))
+	case 3:
+		length = readUint24(cfg.ByteOrder, field)
+	case 4:
+		length = uint64(cfg.ByteOrder.Uint32(field))
+	case 8:
+		length = cfg.ByteOrder.Uint64(field)
+	default:
+		return nil, ErrUnsupportedLength
+	}
+	if length > uint64(cfg.MaxFrameLength) {
+		return nil, ErrFrameTooLong
+	}
+	var frameLength = int(length) + cfg.LengthAdjustment + headerLen
+	if frameLength < headerLen {
+		return nil, ErrTooLessLength
+	}
+	if frameLength > cfg.MaxFrameLength {
+		return nil, ErrFrameTooLong
+	}
+	if frameLength < cfg.InitialBytesToStrip {
+		return nil, ErrInvalidFrameLength
+	}
+	if size, buf = c.ReadN(frameLength); size == 0 {
+		return nil, nil
+	}
+	c.ShiftN(frameLength)
+	return buf[cfg.InitialBytesToStrip:], nil
+}
+
+func readUint24(byteOrder binary.ByteOrder, b []byte) uint64 {
+	_ = b[2]
+	if byteOrder == binary.LittleEndian {
+		return uint64(b[0]) | uint64(b[1])<<8 | uint64(b[2])<<16
+	}
+	return uint64(b[2]) | uint64(b[1])<<8 | uint64(b[0])<<16
+}
+
+func putUint24(byteOrder binary.ByteOrder, b []byte, v uint64) {
+	_ = b[2]
+	if byteOrder == binary.LittleEndian {
+		b[0] = byte(v)
+		b[1] = byte(v >> 8)
+		b[2] = byte(v >> 16)
+		return
+	}
+	b[2] = byte(v)
+	b[1] = byte(v >> 8)
+	b[0] = byte(v >> 16)
+}
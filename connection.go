@@ -1,12 +1,19 @@
 package cnet
 
 import (
+	"bytes"
 	"github.com/cuckooemm/cnet/internal/buf"
 	"github.com/cuckooemm/cnet/internal/netpoll"
+	"github.com/cuckooemm/cnet/internal/timer"
 	"golang.org/x/sys/unix"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// writev单次最多写出的buf数量(IOV_MAX)
+const maxIovec = 1024
+
 var (
 	udpPackPoll = sync.Pool{
 		New: func() interface{} {
@@ -16,23 +23,60 @@ var (
 )
 
 type conn struct {
-	fd                             int                    // file descriptor
-	opened                         bool                   // connection opened event fired
-	data                           map[string]interface{} // user-defined context
-	loop                           *eventTcpLoop          // connected event-loop
-	inBuf, outBuf                  *buf.RingBuffer        // buffer for data from client
-	network, localAddr, remoteAddr string                 // network、local addr and remote addr
+	fd                             int                     // file descriptor
+	opened                         bool                    // connection opened event fired
+	data                           map[string]interface{}  // user-defined context
+	loop                           *eventTcpLoop           // connected event-loop
+	ln                             *tcpListener            // listener accepted the connection, nil if dialed
+	inBuf, outBuf                  *buf.RingBuffer         // buffer for data from client
+	network, localAddr, remoteAddr string                  // network、local addr and remote addr
+	lastRead, lastWrite            time.Time               // time of the last read and write
+	timer                          *timer.Timer            // timeout timer in the loop wheel
+	tasks                          map[*connTimer]struct{} // timers created by AfterFunc and Every
+	frame                          []byte                  // current frame decoded by codec
+	peek                           [2][]byte               // slices returned by Peek
+	scratch                        []byte                  // reused by Next and Until when data wraps around
+	reader                         connReader              // io.Reader view of inBuf
+	handler                        TcpEventHandler         // user eventHandler
+	connecting                     bool                    // dialed and waiting for the connection to be established
+	dial                           chan error              // notify Dial when connecting, nil for DialAsync
+	dialTimer                      *timer.Entry            // connect timeout timer
+	queued                         int64                   // bytes of AsyncWrite not yet written to outBuf
+	buffered                       int64                   // length of outBuf
+	backpressure                   bool                    // outBuf exceeded the high watermark
+	readPaused                     bool                    // EPOLLIN interest removed by PauseRead
+	working                        bool                    // ConnHandler is running in the worker pool
+	closing                        bool                    // closed while working, removed from the poller
+	deferred                       []func() error          // close, wake and timers delayed until ConnHandler returns
+	halfClosed                     bool                    // peer shut down writing, close after outBuf is written
+	tls                            *tlsConn                // tls state, nil if TLSConfig is not set
+	proxy                          *ProxyHeader            // PROXY protocol header
+	proxyPending                   bool                    // waiting for PROXY protocol header
+	proxyTimer                     *timer.Entry            // PROXY protocol header timeout timer
+	limitIP                        string                  // remote ip counted by MaxConnectionsPerIP
+	limited                        bool                    // counted by acceptLimiter
 }
 
-func newTCPConn(fd int, el *eventTcpLoop, sa unix.Sockaddr) *conn {
+// newTCPConn ln为accept的监听，Dial的连接为nil
+func newTCPConn(fd int, el *eventTcpLoop, sa unix.Sockaddr, ln *tcpListener) *conn {
 	var conn = &conn{}
 	conn.fd = fd
 	conn.data = make(map[string]interface{})
 	conn.loop = el
+	conn.ln = ln
+	conn.handler = el.eventHandler
+	conn.reader.c = conn
+	conn.network = el.srv.network
 	conn.localAddr = el.srv.localAddr
+	if ln != nil {
+		conn.network = ln.network
+		conn.localAddr = ln.addr
+	}
 	conn.remoteAddr = netpoll.SocketAddrToTCPOrUnixAddr(sa).String()
 	conn.inBuf = buf.GetRingBuf()
 	conn.outBuf = buf.GetRingBuf()
+	conn.lastRead = time.Now()
+	conn.lastWrite = conn.lastRead
 	return conn
 }
 
@@ -42,40 +86,129 @@ func (c *conn) releaseTCP() {
 	buf.PutRingBuf(c.outBuf)
 	c.inBuf = nil
 	c.outBuf = nil
+	c.peek = [2][]byte{}
+	c.scratch = nil
+}
+
+// 使用codec编码回调返回的数据
+func (c *conn) encode(buf []byte) ([]byte, error) {
+	if codec := c.loop.srv.opt.Codec; codec != nil {
+		return codec.Encode(c, buf)
+	}
+	return buf, nil
+}
+
+// output 编码回调返回的数据并写入连接，超过WriteBufferLimit时按WriteBufferPolicy处理，返回错误时需关闭连接
+func (c *conn) output(buf []byte) (err error) {
+	if buf, err = c.encode(buf); err != nil {
+		return
+	}
+	if c.overflow(len(buf)) {
+		if c.loop.srv.opt.WriteBufferPolicy == OverflowClose {
+			return ErrWriteBufferFull
+		}
+		return nil
+	}
+	c.write(buf)
+	return nil
 }
 
-func (c *conn) open(buf []byte) {
+// overflow 写入n字节后待发送数据是否超过WriteBufferLimit，待发送数据为空时总是允许写入
+func (c *conn) overflow(n int) bool {
 	var (
-		n   int
-		err error
+		limit   = c.loop.srv.opt.WriteBufferLimit
+		pending int
 	)
-	// 写入socket 出错or满  写入outBuf
-	if n, err = unix.Write(c.fd, buf); err != nil {
-		c.outBuf.Write(buf)
+	if limit <= 0 {
+		return false
+	}
+	pending = int(atomic.LoadInt64(&c.queued) + atomic.LoadInt64(&c.buffered))
+	return pending > 0 && pending+n > limit
+}
+
+// checkWatermark 更新outBuf长度，跨越高水位时回调OnBackpressure，回落至低水位时回调OnWritable
+func (c *conn) checkWatermark() {
+	var opt = c.loop.srv.opt
+	if opt.WriteBufferLimit <= 0 && opt.WriteBufferHighWatermark <= 0 {
 		return
 	}
-	if n < len(buf) {
-		c.outBuf.Write(buf[n:])
+	var buffered = c.outBuf.Length()
+	atomic.StoreInt64(&c.buffered, int64(buffered))
+	if opt.WriteBufferHighWatermark <= 0 {
+		return
+	}
+	var (
+		pending = buffered + int(atomic.LoadInt64(&c.queued))
+		h, ok   = c.handler.(IBackpressure)
+	)
+	switch {
+	case !c.backpressure && pending > opt.WriteBufferHighWatermark:
+		c.backpressure = true
+		if ok {
+			h.OnBackpressure(c, pending)
+		}
+	case c.backpressure && pending <= opt.WriteBufferLowWatermark:
+		c.backpressure = false
+		if ok {
+			h.OnWritable(c)
+		}
+	}
+}
+
+// updateEvents 根据读暂停、worker执行、半关闭状态与outBuf是否为空更新监听的事件
+func (c *conn) updateEvents() error {
+	var (
+		poller = c.loop.poller
+		paused = c.readPaused || c.working || c.halfClosed
+		write  = !c.outBuf.IsEmpty()
+	)
+	switch {
+	case paused && write:
+		return poller.ModWrite(c.fd)
+	case paused:
+		return poller.ModNone(c.fd)
+	case write:
+		return poller.ModReadWrite(c.fd)
+	default:
+		return poller.ModRead(c.fd)
 	}
 }
 
 func (c *conn) write(buf []byte) {
+	if buf == nil {
+		return
+	}
+	if c.tls != nil {
+		var err error
+		if buf, err = c.tls.encrypt(buf); err != nil {
+			_ = c.loop.loopCloseConn(c, err)
+			return
+		}
+	}
+	c.send(buf)
+}
+
+// send 将数据写入socket，无法立即写完的数据存入outBuf
+func (c *conn) send(buf []byte) {
 	if buf == nil {
 		return
 	}
 	if !c.outBuf.IsEmpty() {
 		c.outBuf.Write(buf)
+		c.checkWatermark()
 		return
 	}
 	var (
 		n   int
 		err error
 	)
+	c.lastWrite = time.Now()
 	if n, err = unix.Write(c.fd, buf); err != nil {
 		if err == unix.EAGAIN {
 			c.outBuf.Write(buf)
+			c.checkWatermark()
 			// 监听添加可写事件
-			if err = c.loop.poller.ModReadWrite(c.fd); err != nil {
+			if err = c.updateEvents(); err != nil {
 				_ = c.loop.loopCloseConn(c, err)
 			}
 			return
@@ -83,9 +216,59 @@ func (c *conn) write(buf []byte) {
 		_ = c.loop.loopCloseConn(c, err)
 		return
 	}
+	c.loop.stats.addWritten(n)
 	if n < len(buf) {
 		c.outBuf.Write(buf[n:])
-		_ = c.loop.poller.ModReadWrite(c.fd)
+		_ = c.updateEvents()
+	}
+	c.checkWatermark()
+}
+
+// writev 使用一次writev写出多个buf，未写完的数据存入outBuf
+func (c *conn) writev(bufs [][]byte) {
+	// tls连接将所有buf加密为一段密文
+	if c.tls != nil {
+		c.write(bytes.Join(bufs, nil))
+		return
+	}
+	if !c.outBuf.IsEmpty() {
+		for _, b := range bufs {
+			c.outBuf.Write(b)
+		}
+		c.checkWatermark()
+		return
+	}
+	var (
+		iov = bufs
+		n   int
+		err error
+	)
+	if len(iov) > maxIovec {
+		iov = iov[:maxIovec]
+	}
+	c.lastWrite = time.Now()
+	if n, err = unix.Writev(c.fd, iov); err != nil {
+		if err != unix.EAGAIN {
+			_ = c.loop.loopCloseConn(c, err)
+			return
+		}
+		n = 0
+	}
+	c.loop.stats.addWritten(n)
+	for _, b := range bufs {
+		if n >= len(b) {
+			n -= len(b)
+			continue
+		}
+		c.outBuf.Write(b[n:])
+		n = 0
+	}
+	c.checkWatermark()
+	if !c.outBuf.IsEmpty() {
+		// 监听添加可写事件
+		if err = c.updateEvents(); err != nil {
+			_ = c.loop.loopCloseConn(c, err)
+		}
 	}
 }
 
@@ -149,26 +332,125 @@ func (c *conn) BufferLength() int {
 	return c.inBuf.Length()
 }
 
+func (c *conn) ReadFrame() []byte {
+	return c.frame
+}
+
 func (c *conn) AsyncWrite(buf []byte) (err error) {
-	return c.loop.poller.Trigger(func() error {
+	if buf, err = c.encode(buf); err != nil {
+		return
+	}
+	return c.asyncWrite(len(buf), func() {
+		c.write(buf)
+	})
+}
+
+func (c *conn) AsyncWritev(bufs [][]byte) (err error) {
+	var n int
+	if c.loop.srv.opt.Codec != nil {
+		var encoded = make([][]byte, len(bufs))
+		for i, b := range bufs {
+			if encoded[i], err = c.encode(b); err != nil {
+				return
+			}
+		}
+		bufs = encoded
+	}
+	for _, b := range bufs {
+		n += len(b)
+	}
+	return c.asyncWrite(n, func() {
+		c.writev(bufs)
+	})
+}
+
+// asyncWrite 在event-loop中执行write，超过WriteBufferLimit时按WriteBufferPolicy处理
+func (c *conn) asyncWrite(n int, write func()) error {
+	if c.overflow(n) {
+		switch c.loop.srv.opt.WriteBufferPolicy {
+		case OverflowDrop:
+			return nil
+		case OverflowClose:
+			_ = c.trigger(func() error {
+				return c.loop.loopCloseConn(c, ErrWriteBufferFull)
+			})
+		}
+		return ErrWriteBufferFull
+	}
+	atomic.AddInt64(&c.queued, int64(n))
+	var err = c.trigger(func() error {
+		atomic.AddInt64(&c.queued, -int64(n))
 		if c.opened {
-			c.write(buf)
+			write()
 		}
 		return nil
 	})
+	if err != nil {
+		atomic.AddInt64(&c.queued, -int64(n))
+	}
+	return err
+}
+
+// trigger 在event-loop中执行fn，fn中的panic只关闭该连接
+func (c *conn) trigger(fn func() error) error {
+	return c.loop.poller.Trigger(func() error {
+		defer c.loop.recoverConn(c)
+		return fn()
+	})
+}
+
+func (c *conn) AfterFunc(d time.Duration, fn func(c Conn) (out []byte, op Operation)) Timer {
+	return c.loop.afterFunc(c, d, 0, fn)
+}
+
+func (c *conn) Every(d time.Duration, fn func(c Conn) (out []byte, op Operation)) Timer {
+	if d <= 0 {
+		return c.loop.afterFunc(c, 0, 0, fn)
+	}
+	return c.loop.afterFunc(c, d, d, fn)
+}
+
+func (c *conn) PauseRead() error {
+	return c.trigger(func() error {
+		return c.loop.loopPauseRead(c, true)
+	})
+}
+
+func (c *conn) ResumeRead() error {
+	return c.trigger(func() error {
+		return c.loop.loopPauseRead(c, false)
+	})
 }
 
 func (c *conn) Wake() error {
-	return c.loop.poller.Trigger(func() error {
+	return c.trigger(func() error {
 		return c.loop.loopWake(c)
 	})
 }
 func (c *conn) Close() error {
-	return c.loop.poller.Trigger(func() error {
+	return c.trigger(func() error {
 		return c.loop.loopCloseConn(c, nil)
 	})
 }
 
+func (c *conn) PeerCred() (Ucred, error) {
+	if c.network != "unix" {
+		return Ucred{}, ErrNotUnixSocket
+	}
+	var cred, err = unix.GetsockoptUcred(c.fd, unix.SOL_SOCKET, unix.SO_PEERCRED)
+	if err != nil {
+		return Ucred{}, err
+	}
+	return Ucred{Pid: cred.Pid, Uid: cred.Uid, Gid: cred.Gid}, nil
+}
+
+func (c *conn) Listener() string {
+	if c.ln == nil {
+		return ""
+	}
+	return c.ln.name
+}
+
 func (c *conn) Expand() map[string]interface{}        { return c.data }
 func (c *conn) SetExpand(data map[string]interface{}) { c.data = data }
 func (c *conn) Network() string                       { return c.network }
@@ -185,8 +467,13 @@ func newUDPPack(fd int, el *eventUdpLoop, sa unix.Sockaddr) *pack {
 	var pack = udpPackPoll.Get().(*pack)
 	pack.fd = fd
 	pack.sa = sa
+	pack.network = el.srv.network
 	pack.localAddr = el.srv.localAddr
-	pack.remoteAddr = netpoll.SocketAddrToUDPAddr(sa).String()
+	if _, ok := sa.(*unix.SockaddrUnix); ok {
+		pack.remoteAddr = netpoll.SocketAddrToTCPOrUnixAddr(sa).String()
+	} else {
+		pack.remoteAddr = netpoll.SocketAddrToUDPAddr(sa).String()
+	}
 	return pack
 }
 
@@ -5,4 +5,30 @@ import "errors"
 var (
 	ErrServerShutdown    = errors.New("service is going to be shutdown")
 	ErrUnSupportProtocol = errors.New("unsupported protocol")
+	ErrNoListener        = errors.New("no listener specified")
+	ErrIdleTimeout       = errors.New("connection idle timeout")
+	ErrReadTimeout       = errors.New("connection read timeout")
+	ErrWriteTimeout      = errors.New("connection write timeout")
+	ErrConnectTimeout    = errors.New("connect timeout")
+	ErrWriteBufferFull   = errors.New("write buffer is full")
+	ErrUpgradeFailed     = errors.New("upgraded process exited before it was ready")
+	ErrCallbackPanic     = errors.New("callback panic")
+	ErrDialInLoop        = errors.New("blocking Dial in event-loop, use DialAsync instead")
+	// unix socket
+	ErrNotSocketFile = errors.New("file exists and is not a unix socket")
+	ErrSocketInUse   = errors.New("unix socket is in use by another process")
+	ErrNotUnixSocket = errors.New("connection is not a unix socket")
+	// codec
+	ErrInvalidFixedLength = errors.New("invalid fixed length of bytes")
+	ErrUnsupportedLength  = errors.New("unsupported lengthFieldLength. (expected: 1, 2, 3, 4, or 8)")
+	ErrTooLessLength      = errors.New("adjusted frame length is less than zero")
+	ErrTooLongLength      = errors.New("frame length exceeds the range of lengthFieldLength")
+	ErrInvalidFrameLength = errors.New("frame length is less than initialBytesToStrip")
+	ErrFrameTooLong       = errors.New("frame length exceeds MaxFrameLength")
+	ErrEmptyDelimiter     = errors.New("delimiter is empty")
+	ErrInvalidCodecConfig = errors.New("negative LengthFieldOffset, InitialBytesToStrip or MaxFrameLength of codec")
+	// proxy protocol
+	ErrInvalidProxyHeader = errors.New("invalid PROXY protocol header")
+	ErrProxyHeaderTimeout = errors.New("PROXY protocol header read timeout")
+	errProxyIncomplete    = errors.New("incomplete PROXY protocol header")
 )
@@ -2,8 +2,8 @@ package cnet
 
 import (
 	"github.com/cuckooemm/cnet/internal/netpoll"
+	"github.com/cuckooemm/cnet/internal/timer"
 	"golang.org/x/sys/unix"
-	"net"
 	"time"
 )
 
@@ -11,9 +11,18 @@ type eventTcpLoop struct {
 	idx          int             // loop index in the server loops list
 	srv          *tcpServer      // server in loop
 	buffer       []byte          // read buffer
+	iov          [][]byte        // writev buffer
 	poller       *netpoll.Poller // epoll
 	connections  map[int]*conn   // loop connections fd -> conn
-	eventHandler IEventCallback  // user eventHandler
+	eventHandler TcpEventHandler // user eventHandler
+	wheel        *timer.Wheel    // timing wheel for connection timeouts
+	timers       timer.Heap      // timers of AfterFunc, Every and OnTick
+	tick         *timer.Entry    // OnTick timer
+	tickDelay    time.Duration   // delay returned by the last OnTick
+	stats        loopStats       // counters of Stats
+	waiting      []*conn         // connections waiting for a free worker
+	pending      int64           // connections selected by next but not registered yet
+	queued       int32           // waiting is not empty, read by workers to resubmit
 }
 
 type eventUdpLoop struct {
@@ -21,27 +30,30 @@ type eventUdpLoop struct {
 	srv          *udpServer      // server in loop
 	buffer       []byte          // read buffer
 	poller       *netpoll.Poller // epoll
-	eventHandler IEventCallback  // user eventHandler
+	eventHandler UdpEventHandler // user eventHandler
+	stats        loopStats       // counters of Stats
 }
 
 func (el *eventTcpLoop) loopRun() {
+	defer enterLoop(el.srv)()
 	defer el.srv.signalShutdown()
-	el.srv.logger.Printf("event-loop: %d: Listener: %s", el.idx, el.srv.ln.ln.Addr().String())
+	el.srv.logger.Info("event-loop started", "loop", el.idx, "addr", el.srv.localAddr)
 	if err := el.poller.Polling(el.handleEvent); err != nil {
-		el.srv.logger.Printf("closeLoops idx = %d error : %s\n", el.idx, err.Error())
+		el.srv.logger.Info("event-loop exits", "loop", el.idx, "error", err)
 	}
 }
 
 func (el *eventUdpLoop) loopRun() {
+	defer enterLoop(el.srv)()
 	defer el.srv.signalShutdown()
-	el.srv.logger.Printf("event-loop: %d: Listener: %s", el.idx, el.srv.ln.ln.LocalAddr().String())
+	el.srv.logger.Info("event-loop started", "loop", el.idx, "addr", el.srv.localAddr)
 	if err := el.poller.Polling(el.handleEvent); err != nil {
-		el.srv.logger.Printf("closeLoops idx = %d error : %s\n", el.idx, err.Error())
+		el.srv.logger.Info("event-loop exits", "loop", el.idx, "error", err)
 	}
 }
 
 func (el *eventTcpLoop) loopAccept(fd int) error {
-	if fd == el.srv.ln.fd {
+	if ln := el.srv.listener(fd); ln != nil {
 		var (
 			cfd int
 			sa  unix.Sockaddr
@@ -55,40 +67,72 @@ func (el *eventTcpLoop) loopAccept(fd int) error {
 			return err
 		}
 		if err = unix.SetNonblock(cfd, true); err != nil {
+			_ = unix.Close(cfd)
 			return err
 		}
-		var conn = newTCPConn(cfd, el, sa)
-		// 注册事件
-		if err = el.poller.AddRead(conn.fd); err != nil {
-			return err
+		var ip, ok = el.srv.admit(cfd, sa)
+		if !ok {
+			return nil
 		}
-		el.connections[conn.fd] = conn
-		return el.loopOpen(conn)
+		var c = newTCPConn(cfd, el, sa, ln)
+		c.limitIP, c.limited = ip, el.srv.limiter != nil
+		return el.loopAccepted(c)
 	}
 	return nil
 }
 
+// loopAccepted 注册accept的连接
+func (el *eventTcpLoop) loopAccepted(c *conn) error {
+	defer el.recoverConn(c)
+	if err := el.poller.AddConn(c.fd); err != nil {
+		_ = unix.Close(c.fd)
+		el.releaseLimit(c)
+		c.releaseTCP()
+		return err
+	}
+	el.connections[c.fd] = c
+	el.stats.opened()
+	// 先读取PROXY头
+	if c.ln.proxyProtocol != ProxyProtocolOff {
+		el.startProxyTimer(c)
+		return nil
+	}
+	return el.loopEstablish(c)
+}
+
+// loopEstablish 开始TLS握手或直接打开连接
+func (el *eventTcpLoop) loopEstablish(c *conn) error {
+	// tls连接握手完成后再回调OnConnOpened，握手期间同样受超时控制
+	if config := c.ln.tlsConfig; config != nil {
+		c.tls = newTLSConn(c, config)
+		el.startTimer(c)
+		el.startHandshake(c)
+		return nil
+	}
+	return el.loopOpen(c)
+}
+
 func (el *eventTcpLoop) loopOpen(c *conn) error {
 	c.opened = true
-	out, action := el.eventHandler.OnConnOpened(c)
-	if el.srv.opt.TcpKeepAlive > 0 {
-		if _, ok := el.srv.ln.ln.(*net.TCPListener); ok {
-			_ = netpoll.SetKeepAlive(c.fd, int(el.srv.opt.TcpKeepAlive/time.Second))
-		}
+	out, action := c.handler.OnConnOpened(c)
+	if el.srv.opt.TcpKeepAlive > 0 && c.network == "tcp" {
+		_ = netpoll.SetKeepAlive(c.fd, int(el.srv.opt.TcpKeepAlive/time.Second))
 	}
 	if out != nil {
-		c.open(out)
-	}
-	if !c.outBuf.IsEmpty() {
-		_ = el.poller.AddWrite(c.fd)
+		if err := c.output(out); err != nil {
+			return el.loopCloseConn(c, err)
+		}
+		// 写入出错时连接已被关闭
+		if !c.opened {
+			return nil
+		}
 	}
+	el.startTimer(c)
 	return el.handleOperation(c, action)
 }
 func (el *eventTcpLoop) loopRead(c *conn) error {
 	var (
 		n   int
-		out []byte
-		op  Operation
 		err error
 	)
 	if n, err = unix.Read(c.fd, el.buffer); n == 0 || err != nil {
@@ -97,68 +141,214 @@ func (el *eventTcpLoop) loopRead(c *conn) error {
 		}
 		return el.loopCloseConn(c, err)
 	}
-	c.inBuf.Write(el.buffer[:n])
-	if out, op = el.eventHandler.ConnHandler(c); out != nil {
-		c.write(out)
+	return el.loopReceived(c, el.buffer[:n])
+}
+
+// loopReadEdge 边缘触发模式下读取直至EAGAIN，对端半关闭时写完outBuf后关闭连接
+func (el *eventTcpLoop) loopReadEdge(c *conn) error {
+	for !c.readPaused && !c.working && !c.halfClosed {
+		var n, err = unix.Read(c.fd, el.buffer)
+		switch {
+		case err == unix.EAGAIN:
+			return nil
+		case err != nil:
+			return el.loopCloseConn(c, err)
+		case n == 0:
+			return el.loopHalfClose(c)
+		}
+		if err = el.loopReceived(c, el.buffer[:n]); err != nil {
+			return err
+		}
+		// 连接已在回调中关闭
+		if el.connections[c.fd] != c {
+			return nil
+		}
 	}
+	return nil
+}
 
-	switch op {
-	case None:
-	case Close:
+// loopHalfClose 对端关闭写方向，停止读取，待发送数据写完后关闭连接
+func (el *eventTcpLoop) loopHalfClose(c *conn) error {
+	if !c.opened || c.outBuf.IsEmpty() {
 		return el.loopCloseConn(c, nil)
-	case Shutdown:
-		return ErrServerShutdown
+	}
+	c.halfClosed = true
+	if err := c.updateEvents(); err != nil {
+		return el.loopCloseConn(c, err)
 	}
 	return nil
 }
 
+// loopReceived 处理从连接读取的数据
+func (el *eventTcpLoop) loopReceived(c *conn, data []byte) error {
+	c.lastRead = time.Now()
+	el.stats.addRead(len(data))
+	if c.proxyPending {
+		return el.loopReadProxy(c, data)
+	}
+	if c.tls != nil {
+		return el.loopReadTLS(c, data)
+	}
+	c.inBuf.Write(data)
+	return el.loopHandle(c)
+}
+
+// loopHandle 回调ConnHandler处理入站缓冲区中的数据
+func (el *eventTcpLoop) loopHandle(c *conn) error {
+	var (
+		out   []byte
+		op    Operation
+		err   error
+		codec = el.srv.opt.Codec
+	)
+	for {
+		// 设置了codec时每解出一个完整的帧回调一次
+		if codec != nil {
+			if c.frame, err = codec.Decode(c); err != nil {
+				return el.loopCloseConn(c, err)
+			}
+			if c.frame == nil {
+				return nil
+			}
+		}
+		if el.srv.workers != nil {
+			return el.loopDispatch(c)
+		}
+		out, op = c.handler.ConnHandler(c)
+		c.frame = nil
+		if out != nil {
+			if err = c.output(out); err != nil {
+				return el.loopCloseConn(c, err)
+			}
+		}
+
+		switch op {
+		case None:
+		case Close:
+			return el.loopCloseConn(c, nil)
+		case Shutdown:
+			return ErrServerShutdown
+		}
+		if codec == nil || !c.opened {
+			return nil
+		}
+	}
+}
+
 func (el *eventTcpLoop) loopWrite(c *conn) error {
 	var (
 		head, tail []byte
 		n          int
 		err        error
 	)
-	head, tail = c.outBuf.LazyReadAll()
-	if n, err = unix.Write(c.fd, head); err != nil {
-		if err == unix.EAGAIN {
-			return nil
+	// 边缘触发模式下写至outBuf为空或EAGAIN
+	for {
+		head, tail = c.outBuf.LazyReadAll()
+		// 数据跨越环形缓冲区末尾时使用writev一次写出
+		if tail == nil {
+			n, err = unix.Write(c.fd, head)
+		} else {
+			el.iov = append(el.iov[:0], head, tail)
+			n, err = unix.Writev(c.fd, el.iov)
+			el.iov[0], el.iov[1] = nil, nil
 		}
-		return el.loopCloseConn(c, err)
-	}
-	c.outBuf.Shift(n)
-
-	if len(head) == n && tail != nil {
-		if n, err = unix.Write(c.fd, tail); err != nil {
+		if err != nil {
 			if err == unix.EAGAIN {
 				return nil
 			}
 			return el.loopCloseConn(c, err)
 		}
 		c.outBuf.Shift(n)
+		c.lastWrite = time.Now()
+		el.stats.addWritten(n)
+		c.checkWatermark()
+		if c.outBuf.IsEmpty() || !el.srv.opt.EdgeTriggered {
+			break
+		}
 	}
 
 	if c.outBuf.IsEmpty() {
-		if err = el.poller.ModRead(c.fd); err != nil {
+		// 对端已半关闭，数据写完后关闭连接
+		if c.halfClosed {
+			return el.loopCloseConn(c, nil)
+		}
+		if err = c.updateEvents(); err != nil {
 			return el.loopCloseConn(c, err)
 		}
 	}
 	return nil
 }
 
+// loopPauseRead 暂停或恢复读取，连接已关闭或状态未变化时不做处理
+func (el *eventTcpLoop) loopPauseRead(c *conn, paused bool) error {
+	if !c.opened || c.readPaused == paused {
+		return nil
+	}
+	c.readPaused = paused
+	if err := c.updateEvents(); err != nil {
+		return el.loopCloseConn(c, err)
+	}
+	return nil
+}
+
 func (el *eventTcpLoop) loopCloseConn(c *conn, err error) error {
-	if errDel, errClose := el.poller.Delete(c.fd), unix.Close(c.fd); errDel == nil && errClose == nil {
+	// 连接已关闭
+	if el.connections[c.fd] != c {
+		return nil
+	}
+	// worker仍在执行ConnHandler，返回后再关闭，避免OnConnClosed与ConnHandler同时执行
+	if c.working {
+		if !c.closing {
+			c.closing = true
+			// 停止接收事件，对端关闭后EPOLLHUP会持续触发
+			if errDel := el.poller.Delete(c.fd); errDel != nil {
+				el.srv.logger.Error("failed to delete fd from poller", "loop", el.idx, "fd", c.fd, "remote", c.remoteAddr, "error", errDel)
+			}
+			c.deferred = append(c.deferred, func() error {
+				return el.loopCloseConn(c, err)
+			})
+		}
+		return nil
+	}
+	el.stopTimer(c)
+	if c.tls != nil {
+		el.closeTLS(c)
+	}
+	var errDel error
+	if !c.closing {
+		errDel = el.poller.Delete(c.fd)
+	}
+	if errClose := unix.Close(c.fd); errDel == nil && errClose == nil {
 		delete(el.connections, c.fd)
-		switch el.eventHandler.OnConnClosed(c, err) {
-		case Shutdown:
-			return ErrServerShutdown
+		el.stats.closedConn()
+		el.releaseLimit(c)
+		var op Operation
+		switch {
+		case c.opened:
+			op = c.handler.OnConnClosed(c, err)
+		case c.connecting:
+			// 连接尚未建立，通知Dial或DialAsync失败
+			if err == nil {
+				err = ErrServerShutdown
+			}
+			c.connecting = false
+			if c.dial != nil {
+				c.dial <- err
+				c.dial = nil
+			} else {
+				op = c.handler.OnConnClosed(c, err)
+			}
 		}
 		c.releaseTCP()
+		if op == Shutdown {
+			return ErrServerShutdown
+		}
 	} else {
 		if errDel != nil {
-			el.srv.logger.Printf("failed to delete fd: %d from poller: %d, error: %v\n", c.fd, el.idx, errDel)
+			el.srv.logger.Error("failed to delete fd from poller", "loop", el.idx, "fd", c.fd, "remote", c.remoteAddr, "error", errDel)
 		}
 		if errClose != nil {
-			el.srv.logger.Printf("failed to close fd: %d, error:%v\n", c.fd, errClose)
+			el.srv.logger.Error("failed to close fd", "loop", el.idx, "fd", c.fd, "remote", c.remoteAddr, "error", errClose)
 		}
 	}
 	return nil
@@ -169,15 +359,45 @@ func (el *eventTcpLoop) loopWake(c *conn) error {
 		out []byte
 		op  Operation
 	)
-	out, op = el.eventHandler.OnWakenHandler(c)
+	switch {
+	case el.connections[c.fd] != c:
+		// 连接已关闭
+		return nil
+	case c.working:
+		c.deferred = append(c.deferred, func() error {
+			return el.loopWake(c)
+		})
+		return nil
+	}
+	out, op = c.handler.OnWakenHandler(c)
 	if out != nil {
-		c.write(out)
+		if err := c.output(out); err != nil {
+			return el.loopCloseConn(c, err)
+		}
 	}
 	return el.handleOperation(c, op)
 }
 
 func (el *eventTcpLoop) handleEvent(fd int, ev uint32) error {
 	if c, ok := el.connections[fd]; ok {
+		defer el.recoverConn(c)
+		// 等待连接建立
+		if c.connecting {
+			if ev&netpoll.OutEvents != 0 {
+				return el.loopConnected(c, nil)
+			}
+			return nil
+		}
+		// ConnHandler执行期间不读取，对端关闭或出错时关闭连接
+		if c.working && c.outBuf.IsEmpty() {
+			if ev&(unix.EPOLLERR|unix.EPOLLHUP) != 0 {
+				return el.loopCloseConn(c, nil)
+			}
+			return nil
+		}
+		if el.srv.opt.EdgeTriggered {
+			return el.handleEdgeEvent(c, ev)
+		}
 		switch c.outBuf.IsEmpty() {
 		// Don't change the ordering of processing EPOLLOUT | EPOLLRDHUP / EPOLLIN unless you're 100%
 		// sure what you're doing!
@@ -188,20 +408,42 @@ func (el *eventTcpLoop) handleEvent(fd int, ev uint32) error {
 			}
 			return nil
 		case true:
+			// 暂停读取时只会收到EPOLLERR/EPOLLHUP，读取以检测连接关闭
 			if ev&netpoll.InEvents != 0 {
 				return el.loopRead(c)
 			}
 			return nil
 		}
 	}
+	defer el.recoverConn(nil)
 	return el.loopAccept(fd)
 }
 
+// handleEdgeEvent 边缘触发模式下同一次事件可能同时可读可写，且不会重复通知，需分别处理
+func (el *eventTcpLoop) handleEdgeEvent(c *conn, ev uint32) error {
+	if ev&netpoll.OutEvents != 0 && !c.outBuf.IsEmpty() {
+		if err := el.loopWrite(c); err != nil || el.connections[c.fd] != c {
+			return err
+		}
+	}
+	switch {
+	case ev&netpoll.InEvents == 0:
+		return nil
+	case !c.readPaused && !c.working && !c.halfClosed:
+		return el.loopReadEdge(c)
+	case ev&(unix.EPOLLERR|unix.EPOLLHUP) != 0:
+		// 不读取时EPOLLERR/EPOLLHUP只通知一次，直接关闭连接
+		return el.loopCloseConn(c, nil)
+	}
+	return nil
+}
+
 func (el *eventUdpLoop) handleEvent(fd int, _ uint32) error {
 	return el.loopRead(fd)
 }
 
 func (el *eventUdpLoop) loopRead(fd int) error {
+	defer el.recoverPanic()
 	var (
 		n   int
 		sa  unix.Sockaddr
@@ -210,7 +452,7 @@ func (el *eventUdpLoop) loopRead(fd int) error {
 	n, sa, err = unix.Recvfrom(fd, el.buffer, 0)
 	if err != nil || n == 0 {
 		if err != nil && err != unix.EAGAIN {
-			el.srv.logger.Printf("failed to read UPD packet from fd:%d, error:%v\n", fd, err)
+			el.srv.logger.Warn("failed to read UDP packet", "loop", el.idx, "fd", fd, "error", err)
 		}
 		return nil
 	}
@@ -219,10 +461,19 @@ func (el *eventUdpLoop) loopRead(fd int) error {
 		out []byte
 		op  Operation
 	)
+	el.stats.addRead(n)
+	if !el.srv.opt.AccessControl.allowed(sa) {
+		if h, ok := el.eventHandler.(IConnRejected); ok {
+			h.OnConnRejected(netpoll.SocketAddrToUDPAddr(sa).String(), RejectAccessDenied)
+		}
+		return nil
+	}
 	p = newUDPPack(fd, el, sa)
 	if out, op = el.eventHandler.PackHandler(el.buffer[:n], p); out != nil {
 		if err = p.sendTo(out); err != nil {
 			el.eventHandler.SendErr(p.remoteAddr, err)
+		} else {
+			el.stats.addWritten(len(out))
 		}
 	}
 	switch op {
@@ -237,10 +488,14 @@ func (el *eventTcpLoop) handleOperation(c *conn, op Operation) error {
 	case None:
 		return nil
 	case Close:
-		_ = el.loopWrite(c)
+		if c.opened {
+			_ = el.loopWrite(c)
+		}
 		return el.loopCloseConn(c, nil)
 	case Shutdown:
-		_ = el.loopWrite(c)
+		if c.opened {
+			_ = el.loopWrite(c)
+		}
 		return ErrServerShutdown
 	default:
 		return nil
@@ -1,32 +1,138 @@
 package cnet
 
+import (
+	"github.com/cuckooemm/cnet/internal/netpoll"
+	"golang.org/x/sys/unix"
+	"hash/fnv"
+	"net"
+	"sync/atomic"
+)
+
 type IEventTcpLoopGroup interface {
 	register(loop *eventTcpLoop)
-	next() *eventTcpLoop
+	next(sa unix.Sockaddr) *eventTcpLoop
 	iterate(func(*eventTcpLoop) bool)
 	len() int
 }
 
-type roundRobinEventLoopGroup struct {
-	nextLoopIndex int
-	eventLoops    []*eventTcpLoop
-	size          int
+// LoadBalancing 主reactor(未开启ReusePort)与Client.Dial为新连接选择event-loop的策略
+type LoadBalancing int
+
+const (
+	// 轮询
+	RoundRobin LoadBalancing = iota
+	// 选择当前连接数最少的event-loop
+	LeastConnections
+	// 按对端IP哈希，同一IP的连接总是分配到同一event-loop
+	SourceAddrHash
+)
+
+// LoopInfo event-loop的状态，供LoadBalancer选择
+type LoopInfo interface {
+	// Index event-loop下标
+	Index() int
+	// Connections 当前连接数，包括已分配给该event-loop但尚未注册的连接
+	Connections() int
+}
+
+// LoadBalancer 自定义event-loop选择，Select可能被并发调用
+type LoadBalancer interface {
+	// Select 返回loops中被选中的下标，remote为新连接的对端地址
+	Select(remote net.Addr, loops []LoopInfo) int
+}
+
+func (el *eventTcpLoop) Index() int { return el.idx }
+func (el *eventTcpLoop) Connections() int {
+	return int(atomic.LoadInt64(&el.stats.connections) + atomic.LoadInt64(&el.pending))
+}
+
+// newLoadBalancer 优先使用自定义的LoadBalancer
+func newLoadBalancer(opt *TcpOption) LoadBalancer {
+	if opt.LoadBalancer != nil {
+		return opt.LoadBalancer
+	}
+	switch opt.LoadBalancing {
+	case LeastConnections:
+		return leastConnections{}
+	case SourceAddrHash:
+		return sourceAddrHash{}
+	default:
+		return new(roundRobin)
+	}
+}
+
+type roundRobin struct {
+	nextLoopIndex uint64 // Dial may call Select concurrently
+}
+
+func (lb *roundRobin) Select(_ net.Addr, loops []LoopInfo) int {
+	return int((atomic.AddUint64(&lb.nextLoopIndex, 1) - 1) % uint64(len(loops)))
 }
 
-func (g *roundRobinEventLoopGroup) register(el *eventTcpLoop) {
+type leastConnections struct{}
+
+func (leastConnections) Select(_ net.Addr, loops []LoopInfo) int {
+	var idx, min = 0, loops[0].Connections()
+	for i := 1; i < len(loops); i++ {
+		if n := loops[i].Connections(); n < min {
+			idx, min = i, n
+		}
+	}
+	return idx
+}
+
+type sourceAddrHash struct{}
+
+func (sourceAddrHash) Select(remote net.Addr, loops []LoopInfo) int {
+	var h = fnv.New32a()
+	switch addr := remote.(type) {
+	case *net.TCPAddr:
+		_, _ = h.Write(addr.IP)
+	case nil:
+	default:
+		_, _ = h.Write([]byte(addr.String()))
+	}
+	return int(h.Sum32() % uint32(len(loops)))
+}
+
+type eventLoopGroup struct {
+	lb         LoadBalancer
+	eventLoops []*eventTcpLoop
+	infos      []LoopInfo
+	size       int
+}
+
+func newEventLoopGroup(opt *TcpOption) *eventLoopGroup {
+	return &eventLoopGroup{lb: newLoadBalancer(opt)}
+}
+
+func (g *eventLoopGroup) register(el *eventTcpLoop) {
 	g.eventLoops = append(g.eventLoops, el)
+	g.infos = append(g.infos, el)
 	g.size++
 }
 
-func (g *roundRobinEventLoopGroup) next() (el *eventTcpLoop) {
-	el = g.eventLoops[g.nextLoopIndex]
-	if g.nextLoopIndex++; g.nextLoopIndex >= g.size {
-		g.nextLoopIndex = 0
+// next 为新连接选择event-loop并计入其待注册连接数，调用方在连接注册完成或失败后调用el.assigned
+func (g *eventLoopGroup) next(sa unix.Sockaddr) *eventTcpLoop {
+	var idx int
+	if g.size > 1 {
+		idx = g.lb.Select(netpoll.SocketAddrToTCPOrUnixAddr(sa), g.infos)
+		// 自定义LoadBalancer返回越界的下标时使用第一个event-loop
+		if idx < 0 || idx >= g.size {
+			idx = 0
+		}
 	}
-	return
+	var el = g.eventLoops[idx]
+	atomic.AddInt64(&el.pending, 1)
+	return el
+}
+
+// assigned next分配的连接已注册(已计入连接数)或注册失败
+func (el *eventTcpLoop) assigned() {
+	atomic.AddInt64(&el.pending, -1)
 }
 
-func (g *roundRobinEventLoopGroup) iterate(f func(*eventTcpLoop) bool) {
+func (g *eventLoopGroup) iterate(f func(*eventTcpLoop) bool) {
 	for _, el := range g.eventLoops {
 		if !f(el) {
 			break
@@ -34,6 +140,6 @@ func (g *roundRobinEventLoopGroup) iterate(f func(*eventTcpLoop) bool) {
 	}
 }
 
-func (g *roundRobinEventLoopGroup) len() int {
+func (g *eventLoopGroup) len() int {
 	return g.size
 }
@@ -8,6 +8,7 @@ import (
 )
 
 type serverCallback struct {
+	cnet.EventServer
 	connTotal, connected, close int64
 	spanDown, spanUp            int64
 }
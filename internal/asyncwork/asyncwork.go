@@ -1,14 +1,19 @@
 package asyncwork
 
 import (
+	"runtime/debug"
 	"sync"
 )
 
 type Work func() error
 
+// PanicHandler 任务panic时回调，stack为panic时的调用栈
+type PanicHandler func(v interface{}, stack []byte)
+
 type Queue struct {
-	lc    sync.Locker
-	works []func() error
+	lc      sync.Locker
+	works   []func() error
+	onPanic PanicHandler
 }
 
 func NewQueue() Queue {
@@ -23,15 +28,39 @@ func (q *Queue) Add(work Work) (count int) {
 	return
 }
 
+// Len 返回待执行的任务数量
+func (q *Queue) Len() (count int) {
+	q.lc.Lock()
+	count = len(q.works)
+	q.lc.Unlock()
+	return
+}
+
 func (q *Queue) Exec() (err error) {
 	q.lc.Lock()
 	var works = q.works
 	q.works = make([]func() error, 0, len(works))
 	q.lc.Unlock()
 	for _, work := range works {
-		if err = work(); err != nil {
+		if err = q.exec(work); err != nil {
 			return
 		}
 	}
 	return
 }
+
+// SetPanicHandler 设置后任务中的panic被恢复并回调h，之后的任务继续执行
+func (q *Queue) SetPanicHandler(h PanicHandler) {
+	q.onPanic = h
+}
+
+func (q *Queue) exec(work func() error) error {
+	if q.onPanic != nil {
+		defer func() {
+			if v := recover(); v != nil {
+				q.onPanic(v, debug.Stack())
+			}
+		}()
+	}
+	return work()
+}
@@ -26,6 +26,8 @@ type Pool struct {
 	defaultSize uint64
 	maxSize     uint64
 
+	gets, puts, allocs uint64
+
 	pool sync.Pool
 }
 
@@ -35,16 +37,26 @@ func init() {
 
 func GetRingBuf() *RingBuffer  { return defaultPool.Get() }
 func PutRingBuf(b *RingBuffer) { defaultPool.Put(b) }
+func PoolStats() Stats         { return defaultPool.Stats() }
+
+// Stats 缓冲池状态
+type Stats struct {
+	DefaultSize, MaxSize int    // 新建缓冲区的大小与放回池中的缓冲区大小上限
+	Gets, Puts, Allocs   uint64 // 取出、放回与新建缓冲区的次数
+}
 
 func (p *Pool) Get() *RingBuffer {
+	atomic.AddUint64(&p.gets, 1)
 	v := p.pool.Get()
 	if v != nil {
 		return v.(*RingBuffer)
 	}
+	atomic.AddUint64(&p.allocs, 1)
 	return NewRingBuf(int(atomic.LoadUint64(&p.defaultSize)))
 }
 
 func (p *Pool) Put(b *RingBuffer) {
+	atomic.AddUint64(&p.puts, 1)
 	idx := index(b.Len())
 
 	if atomic.AddUint64(&p.calls[idx], 1) > calibrateCallsThreshold {
@@ -58,6 +70,16 @@ func (p *Pool) Put(b *RingBuffer) {
 	}
 }
 
+func (p *Pool) Stats() Stats {
+	return Stats{
+		DefaultSize: int(atomic.LoadUint64(&p.defaultSize)),
+		MaxSize:     int(atomic.LoadUint64(&p.maxSize)),
+		Gets:        atomic.LoadUint64(&p.gets),
+		Puts:        atomic.LoadUint64(&p.puts),
+		Allocs:      atomic.LoadUint64(&p.allocs),
+	}
+}
+
 func (p *Pool) calibrate() {
 	if !atomic.CompareAndSwapUint64(&p.calibrating, 0, 1) {
 		return
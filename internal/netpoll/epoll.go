@@ -1,12 +1,17 @@
 package netpoll
 
 import (
+	"errors"
 	"github.com/cuckooemm/cnet/internal/asyncwork"
 	"golang.org/x/sys/unix"
-	"log"
+	"sync"
+	"sync/atomic"
 	"unsafe"
 )
 
+// ErrPollerClosed Close之后调用Trigger
+var ErrPollerClosed = errors.New("poller is closed")
+
 const (
 	readEvents      = unix.EPOLLPRI | unix.EPOLLIN
 	writeEvents     = unix.EPOLLOUT
@@ -18,6 +23,25 @@ type Poller struct {
 	wfd       int    // wake fd
 	wfdBuf    []byte // wfd buffer to read byte
 	asyncWork asyncwork.Queue
+	timer     Timer
+	wakeups   uint64 // times of epoll_wait returned
+	logger    Logger
+	edge      bool         // connection fds are edge-triggered
+	mu        sync.RWMutex // Trigger与Close互斥，避免写入已关闭的wfd
+	closed    bool
+}
+
+// Logger 记录Polling中的错误
+type Logger interface {
+	Error(msg string, kv ...interface{})
+}
+
+// Timer 为Polling提供epoll_wait的超时时间，每轮事件处理完成后执行到期任务
+type Timer interface {
+	// Timeout 返回epoll_wait等待的毫秒数，-1表示一直阻塞
+	Timeout() int
+	// Expire 执行已到期的任务，返回错误时Polling退出
+	Expire() error
 }
 
 // CreatePoller instantiates a poller.
@@ -45,9 +69,16 @@ func (p *Poller) Polling(callback func(fd int, ev uint32) error) (err error) {
 	var eventList = newEventList(InitEvents)
 	var waken bool
 	for {
-		var n int
-		if n, err = unix.EpollWait(p.efd, eventList.events, -1); err != nil && err != unix.EINTR {
-			log.Println(err)
+		var n, timeout = 0, -1
+		if p.timer != nil {
+			timeout = p.timer.Timeout()
+		}
+		n, err = unix.EpollWait(p.efd, eventList.events, timeout)
+		atomic.AddUint64(&p.wakeups, 1)
+		if err != nil && err != unix.EINTR {
+			if p.logger != nil {
+				p.logger.Error("epoll_wait failed", "efd", p.efd, "error", err)
+			}
 			continue
 		}
 		for i := 0; i < n; i++ {
@@ -67,13 +98,55 @@ func (p *Poller) Polling(callback func(fd int, ev uint32) error) (err error) {
 				return
 			}
 		}
+		if p.timer != nil {
+			if err = p.timer.Expire(); err != nil {
+				return
+			}
+		}
 		if n == eventList.size {
 			eventList.increase()
 		}
 	}
 }
 
+// Wakeups 返回epoll_wait返回的次数
+func (p *Poller) Wakeups() uint64 {
+	return atomic.LoadUint64(&p.wakeups)
+}
+
+// AsyncTasks 返回待执行的异步任务数量
+func (p *Poller) AsyncTasks() int {
+	return p.asyncWork.Len()
+}
+
+// SetPanicHandler Trigger的函数panic时回调h，Polling继续运行，必须在Polling之前调用
+func (p *Poller) SetPanicHandler(h func(v interface{}, stack []byte)) {
+	p.asyncWork.SetPanicHandler(h)
+}
+
+// SetEdgeTriggered 连接fd(AddConn、AddWrite与Mod*)使用边缘触发，监听fd与唤醒fd仍为水平触发，必须在Polling之前调用
+func (p *Poller) SetEdgeTriggered() {
+	p.edge = true
+}
+
+// SetLogger 设置日志，必须在Polling之前调用
+func (p *Poller) SetLogger(l Logger) {
+	p.logger = l
+}
+
+// SetTimer 设置定时器，必须在Polling之前调用
+func (p *Poller) SetTimer(t Timer) {
+	p.timer = t
+}
+
+// Close 关闭epoll fd与wake fd，之后Trigger返回ErrPollerClosed
 func (p *Poller) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return ErrPollerClosed
+	}
+	p.closed = true
 	if err := unix.Close(p.wfd); err != nil {
 		return err
 	}
@@ -88,6 +161,11 @@ var (
 )
 
 func (p *Poller) Trigger(w asyncwork.Work) error {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.closed {
+		return ErrPollerClosed
+	}
 	if p.asyncWork.Add(w) == 1 {
 		_, err := unix.Write(p.wfd, b)
 		return err
@@ -100,16 +178,43 @@ func (p *Poller) AddRead(fd int) error {
 	return unix.EpollCtl(p.efd, unix.EPOLL_CTL_ADD, fd, &unix.EpollEvent{Fd: int32(fd), Events: readEvents})
 }
 
+// AddConn 注册连接fd的可读事件，与AddRead的区别是边缘触发模式下使用EPOLLET
+func (p *Poller) AddConn(fd int) error {
+	return unix.EpollCtl(p.efd, unix.EPOLL_CTL_ADD, fd, &unix.EpollEvent{Fd: int32(fd), Events: p.connEvents(readEvents)})
+}
+
 func (p *Poller) AddWrite(fd int) error {
-	return unix.EpollCtl(p.efd, unix.EPOLL_CTL_ADD, fd, &unix.EpollEvent{Fd: int32(fd), Events: writeEvents})
+	return unix.EpollCtl(p.efd, unix.EPOLL_CTL_ADD, fd, &unix.EpollEvent{Fd: int32(fd), Events: p.connEvents(writeEvents)})
 }
 
 func (p *Poller) ModReadWrite(fd int) error {
-	return unix.EpollCtl(p.efd, unix.EPOLL_CTL_MOD, fd, &unix.EpollEvent{Fd: int32(fd), Events: readWriteEvents})
+	return unix.EpollCtl(p.efd, unix.EPOLL_CTL_MOD, fd, &unix.EpollEvent{Fd: int32(fd), Events: p.connEvents(readWriteEvents)})
 }
 
 func (p *Poller) ModRead(fd int) error {
-	return unix.EpollCtl(p.efd, unix.EPOLL_CTL_MOD, fd, &unix.EpollEvent{Fd: int32(fd), Events: readEvents})
+	return unix.EpollCtl(p.efd, unix.EPOLL_CTL_MOD, fd, &unix.EpollEvent{Fd: int32(fd), Events: p.connEvents(readEvents)})
+}
+
+// ModWrite 只监听可写事件，用于暂停读取的连接
+func (p *Poller) ModWrite(fd int) error {
+	return unix.EpollCtl(p.efd, unix.EPOLL_CTL_MOD, fd, &unix.EpollEvent{Fd: int32(fd), Events: p.connEvents(writeEvents)})
+}
+
+// ModNone 不监听读写事件，仍会收到EPOLLERR与EPOLLHUP
+func (p *Poller) ModNone(fd int) error {
+	return unix.EpollCtl(p.efd, unix.EPOLL_CTL_MOD, fd, &unix.EpollEvent{Fd: int32(fd), Events: p.connEvents(0)})
+}
+
+// connEvents 边缘触发模式下附加EPOLLET，监听可读时同时监听EPOLLRDHUP
+func (p *Poller) connEvents(events uint32) uint32 {
+	if !p.edge {
+		return events
+	}
+	events |= unix.EPOLLET
+	if events&unix.EPOLLIN != 0 {
+		events |= unix.EPOLLRDHUP
+	}
+	return events
 }
 
 func (p *Poller) Delete(fd int) error {
@@ -0,0 +1,94 @@
+package timer
+
+import (
+	"container/heap"
+	"time"
+)
+
+// Heap 最小堆定时器，非并发安全，只能在所属event-loop的goroutine中使用
+type Heap struct {
+	entries entries
+}
+
+type Entry struct {
+	at    time.Time
+	fn    func() error
+	index int // index in the heap, -1 if not scheduled
+}
+
+// AfterFunc 在d之后执行fn，fn返回的错误由Expire返回
+func (h *Heap) AfterFunc(d time.Duration, fn func() error) *Entry {
+	var e = &Entry{fn: fn, index: -1}
+	h.Reset(e, d)
+	return e
+}
+
+// Reset 重新设置e在d之后执行
+func (h *Heap) Reset(e *Entry, d time.Duration) {
+	e.at = time.Now().Add(d)
+	if e.index >= 0 {
+		heap.Fix(&h.entries, e.index)
+		return
+	}
+	heap.Push(&h.entries, e)
+}
+
+// Remove 移除e，e未被调度时不做任何操作
+func (h *Heap) Remove(e *Entry) {
+	if e.index >= 0 {
+		heap.Remove(&h.entries, e.index)
+	}
+}
+
+// Timeout 返回距最近一个定时任务的毫秒数，没有定时任务时返回-1
+func (h *Heap) Timeout(now time.Time) int {
+	if len(h.entries) == 0 {
+		return -1
+	}
+	var d = h.entries[0].at.Sub(now)
+	if d <= 0 {
+		return 0
+	}
+	return int((d + time.Millisecond - 1) / time.Millisecond)
+}
+
+// Expire 执行所有在now之前到期的定时任务
+func (h *Heap) Expire(now time.Time) error {
+	for len(h.entries) > 0 && !h.entries[0].at.After(now) {
+		var e = heap.Pop(&h.entries).(*Entry)
+		if err := e.fn(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (h *Heap) Len() int { return len(h.entries) }
+
+type entries []*Entry
+
+func (es entries) Len() int           { return len(es) }
+func (es entries) Less(i, j int) bool { return es[i].at.Before(es[j].at) }
+func (es entries) Swap(i, j int) {
+	es[i], es[j] = es[j], es[i]
+	es[i].index = i
+	es[j].index = j
+}
+
+func (es *entries) Push(x interface{}) {
+	var e = x.(*Entry)
+	e.index = len(*es)
+	*es = append(*es, e)
+}
+
+func (es *entries) Pop() interface{} {
+	var (
+		old = *es
+		n   = len(old)
+		e   = old[n-1]
+	)
+	old[n-1] = nil
+	e.index = -1
+	*es = old[:n-1]
+	return e
+}
@@ -0,0 +1,143 @@
+package timer
+
+import "time"
+
+// Wheel 哈希时间轮，非并发安全，只能在所属event-loop的goroutine中使用
+type Wheel struct {
+	tick    time.Duration
+	slots   []*Timer
+	pos     int       // current slot
+	last    time.Time // time of the last tick
+	count   int       // number of scheduled timers
+	expired []*Timer  // reused buffer of expired timers
+}
+
+type Timer struct {
+	wheel      *Wheel
+	fn         func() error
+	slot       int
+	rounds     int
+	scheduled  bool // in a slot of the wheel
+	pending    bool // expired but not yet fired
+	prev, next *Timer
+}
+
+func NewWheel(tick time.Duration, size int) *Wheel {
+	if size < 1 {
+		size = 1
+	}
+	return &Wheel{
+		tick:  tick,
+		slots: make([]*Timer, size),
+	}
+}
+
+// AfterFunc 在d之后执行fn，fn返回的错误由Advance返回
+func (w *Wheel) AfterFunc(d time.Duration, fn func() error) *Timer {
+	var t = &Timer{wheel: w, fn: fn}
+	w.add(t, d, time.Now())
+	return t
+}
+
+// Timeout 返回距下一个tick的毫秒数，没有定时任务时返回-1
+func (w *Wheel) Timeout(now time.Time) int {
+	if w.count == 0 {
+		return -1
+	}
+	var d = w.last.Add(w.tick).Sub(now)
+	if d <= 0 {
+		return 0
+	}
+	return int((d + time.Millisecond - 1) / time.Millisecond)
+}
+
+// Advance 推进时间轮至now，执行到期的定时任务
+func (w *Wheel) Advance(now time.Time) (err error) {
+	for w.count > 0 && now.Sub(w.last) >= w.tick {
+		w.last = w.last.Add(w.tick)
+		if w.pos++; w.pos == len(w.slots) {
+			w.pos = 0
+		}
+		if err = w.expire(w.pos); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (w *Wheel) Len() int { return w.count }
+
+func (w *Wheel) expire(slot int) error {
+	var next *Timer
+	w.expired = w.expired[:0]
+	for t := w.slots[slot]; t != nil; t = next {
+		next = t.next
+		if t.rounds > 0 {
+			t.rounds--
+			continue
+		}
+		w.remove(t)
+		t.pending = true
+		w.expired = append(w.expired, t)
+	}
+	// 定时任务可能会重置或停止其他已到期的定时器
+	for i, t := range w.expired {
+		w.expired[i] = nil
+		if !t.pending {
+			continue
+		}
+		t.pending = false
+		if err := t.fn(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *Wheel) add(t *Timer, d time.Duration, now time.Time) {
+	if w.count == 0 {
+		w.last = now
+	}
+	var ticks = int((now.Sub(w.last) + d + w.tick - 1) / w.tick)
+	if ticks < 1 {
+		ticks = 1
+	}
+	t.slot = (w.pos + ticks) % len(w.slots)
+	t.rounds = (ticks - 1) / len(w.slots)
+	t.prev = nil
+	t.next = w.slots[t.slot]
+	if t.next != nil {
+		t.next.prev = t
+	}
+	w.slots[t.slot] = t
+	t.scheduled = true
+	w.count++
+}
+
+func (w *Wheel) remove(t *Timer) {
+	if t.prev != nil {
+		t.prev.next = t.next
+	} else {
+		w.slots[t.slot] = t.next
+	}
+	if t.next != nil {
+		t.next.prev = t.prev
+	}
+	t.prev, t.next = nil, nil
+	t.scheduled = false
+	w.count--
+}
+
+// Reset 重新设置定时器在d之后执行
+func (t *Timer) Reset(d time.Duration) {
+	t.Stop()
+	t.wheel.add(t, d, time.Now())
+}
+
+// Stop 停止定时器
+func (t *Timer) Stop() {
+	if t.scheduled {
+		t.wheel.remove(t)
+	}
+	t.pending = false
+}
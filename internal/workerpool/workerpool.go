@@ -0,0 +1,64 @@
+package workerpool
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// Pool 固定数量的goroutine执行任务，等待执行的任务数量有上限
+type Pool struct {
+	tasks chan func() func()
+	size  int64 // workers + queue
+	busy  int64 // 执行中与等待执行的任务数量
+	once  sync.Once
+	wg    sync.WaitGroup // worker goroutine退出
+}
+
+// New 启动workers个goroutine，最多queue个任务等待执行
+// enter不为nil时在每个goroutine开始时调用，返回的函数在goroutine退出时调用
+func New(workers, queue int, enter func() (exit func())) *Pool {
+	var p = &Pool{tasks: make(chan func() func(), workers+queue), size: int64(workers + queue)}
+	p.wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go p.run(enter)
+	}
+	return p
+}
+
+func (p *Pool) run(enter func() (exit func())) {
+	defer p.wg.Done()
+	if enter != nil {
+		defer enter()()
+	}
+	for task := range p.tasks {
+		var done = task()
+		atomic.AddInt64(&p.busy, -1)
+		if done != nil {
+			done()
+		}
+	}
+}
+
+// TrySubmit 提交任务，执行中与等待执行的任务达到workers+queue时返回false，Close之后不能调用
+// task返回的函数在任务释放占用之后执行，其中再调用TrySubmit不会因该任务失败
+func (p *Pool) TrySubmit(task func() (done func())) bool {
+	if atomic.AddInt64(&p.busy, 1) > p.size {
+		atomic.AddInt64(&p.busy, -1)
+		return false
+	}
+	p.tasks <- task
+	return true
+}
+
+// Len 返回等待执行的任务数量
+func (p *Pool) Len() int {
+	return len(p.tasks)
+}
+
+// Close 执行完等待中的任务后退出全部goroutine，阻塞至全部goroutine退出，不能在任务中调用
+func (p *Pool) Close() {
+	p.once.Do(func() {
+		close(p.tasks)
+	})
+	p.wg.Wait()
+}
@@ -0,0 +1,221 @@
+package cnet
+
+import (
+	"github.com/cuckooemm/cnet/internal/netpoll"
+	"golang.org/x/sys/unix"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// RejectReason 连接被拒绝的原因
+type RejectReason int
+
+const (
+	// 超过TcpOption.MaxConnections
+	RejectMaxConnections RejectReason = iota
+	// 超过TcpOption.MaxConnectionsPerIP
+	RejectMaxConnectionsPerIP
+	// 超过TcpOption.AcceptRate
+	RejectRateLimited
+	// 不允许AccessControl访问
+	RejectAccessDenied
+)
+
+func (r RejectReason) String() string {
+	switch r {
+	case RejectMaxConnections:
+		return "max connections"
+	case RejectMaxConnectionsPerIP:
+		return "max connections per ip"
+	case RejectRateLimited:
+		return "accept rate limited"
+	case RejectAccessDenied:
+		return "access denied"
+	default:
+		return "unknown"
+	}
+}
+
+// IConnRejected 可选实现，accept的连接被拒绝并关闭后回调，在accept所在的event-loop中执行
+// udp服务丢弃AccessControl不允许的数据包后回调
+type IConnRejected interface {
+	OnConnRejected(addr string, reason RejectReason)
+}
+
+// 空闲的令牌桶超过该时间后清理
+const bucketSweepInterval = time.Minute
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// acceptLimiter 连接数与accept速率限制，由所有event-loop共享
+type acceptLimiter struct {
+	opt     *TcpOption
+	conns   int64
+	mu      sync.Mutex
+	perIP   map[string]int
+	buckets map[string]*tokenBucket
+	sweep   time.Time
+}
+
+// 未配置任何限制时返回nil
+func newAcceptLimiter(opt *TcpOption) *acceptLimiter {
+	if opt.MaxConnections <= 0 && opt.MaxConnectionsPerIP <= 0 && opt.AcceptRate <= 0 {
+		return nil
+	}
+	return &acceptLimiter{
+		opt:     opt,
+		perIP:   make(map[string]int),
+		buckets: make(map[string]*tokenBucket),
+		sweep:   time.Now(),
+	}
+}
+
+// sockaddrIP 返回对端IP，unix socket返回nil
+func sockaddrIP(sa unix.Sockaddr) net.IP {
+	switch sa := sa.(type) {
+	case *unix.SockaddrInet4:
+		return net.IP(sa.Addr[:])
+	case *unix.SockaddrInet6:
+		return net.IP(sa.Addr[:])
+	}
+	return nil
+}
+
+// acquire 检查是否允许接受连接，允许时计入连接数并返回对端IP，连接关闭时需调用release
+func (l *acceptLimiter) acquire(sa unix.Sockaddr) (string, bool, RejectReason) {
+	var (
+		opt = l.opt
+		ip  = sockaddrIP(sa)
+		key string
+	)
+	if opt.MaxConnections > 0 && atomic.AddInt64(&l.conns, 1) > int64(opt.MaxConnections) {
+		atomic.AddInt64(&l.conns, -1)
+		return "", false, RejectMaxConnections
+	}
+	if ip == nil {
+		return "", true, 0
+	}
+	key = ip.String()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if opt.MaxConnectionsPerIP > 0 && l.perIP[key] >= opt.MaxConnectionsPerIP {
+		l.releaseTotal()
+		return "", false, RejectMaxConnectionsPerIP
+	}
+	if opt.AcceptRate > 0 && !l.allow(ip, time.Now()) {
+		l.releaseTotal()
+		return "", false, RejectRateLimited
+	}
+	if opt.MaxConnectionsPerIP > 0 {
+		l.perIP[key]++
+	}
+	return key, true, 0
+}
+
+func (l *acceptLimiter) releaseTotal() {
+	if l.opt.MaxConnections > 0 {
+		atomic.AddInt64(&l.conns, -1)
+	}
+}
+
+// release 连接关闭，ip为acquire返回的对端IP
+func (l *acceptLimiter) release(ip string) {
+	l.releaseTotal()
+	if ip == "" || l.opt.MaxConnectionsPerIP <= 0 {
+		return
+	}
+	l.mu.Lock()
+	if l.perIP[ip] <= 1 {
+		delete(l.perIP, ip)
+	} else {
+		l.perIP[ip]--
+	}
+	l.mu.Unlock()
+}
+
+// allow 按来源网段的令牌桶限制accept速率，调用时需持有mu
+func (l *acceptLimiter) allow(ip net.IP, now time.Time) bool {
+	var (
+		opt   = l.opt
+		burst = float64(opt.AcceptBurst)
+		key   = l.rateKey(ip)
+	)
+	if burst < 1 {
+		burst = 1
+	}
+	if now.Sub(l.sweep) > bucketSweepInterval {
+		l.sweep = now
+		for k, b := range l.buckets {
+			if b.tokens+now.Sub(b.last).Seconds()*opt.AcceptRate >= burst {
+				delete(l.buckets, k)
+			}
+		}
+	}
+	var b, ok = l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * opt.AcceptRate
+	b.last = now
+	if b.tokens > burst {
+		b.tokens = burst
+	}
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// rateKey 按AcceptRateIPv4Prefix/AcceptRateIPv6Prefix将IP归为同一来源
+func (l *acceptLimiter) rateKey(ip net.IP) string {
+	var ones, bits = l.opt.AcceptRateIPv4Prefix, 32
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	} else {
+		ones, bits = l.opt.AcceptRateIPv6Prefix, 128
+	}
+	if ones <= 0 || ones > bits {
+		ones = bits
+	}
+	return ip.Mask(net.CIDRMask(ones, bits)).String()
+}
+
+// releaseLimit 连接关闭时释放acquire计入的连接数
+func (el *eventTcpLoop) releaseLimit(c *conn) {
+	if c.limited {
+		c.limited = false
+		el.srv.limiter.release(c.limitIP)
+	}
+}
+
+// admit 检查accept的连接，被拒绝时关闭连接并回调OnConnRejected，超过限制时关闭前写入RejectMessage
+func (srv *tcpServer) admit(fd int, sa unix.Sockaddr) (ip string, ok bool) {
+	var reason RejectReason
+	switch {
+	case !srv.opt.AccessControl.allowed(sa):
+		reason = RejectAccessDenied
+	case srv.limiter == nil:
+		return "", true
+	default:
+		if ip, ok, reason = srv.limiter.acquire(sa); ok {
+			return
+		}
+		if msg := srv.opt.RejectMessage; len(msg) > 0 {
+			_, _ = unix.Write(fd, msg)
+		}
+	}
+	_ = unix.Close(fd)
+	var addr = netpoll.SocketAddrToTCPOrUnixAddr(sa).String()
+	srv.logger.Debug("connection rejected", "remote", addr, "reason", reason)
+	if h, is := srv.eventHandler.(IConnRejected); is {
+		h.OnConnRejected(addr, reason)
+	}
+	return "", false
+}
@@ -1,6 +1,9 @@
 package cnet
 
 import (
+	"crypto/tls"
+	"errors"
+	"github.com/cuckooemm/cnet/internal"
 	"golang.org/x/sys/unix"
 	"net"
 	"os"
@@ -8,22 +11,159 @@ import (
 )
 
 type tcpListener struct {
-	f    *os.File
-	fd   int
-	ln   net.Listener
-	once sync.Once
+	f             *os.File
+	fd            int
+	ln            net.Listener
+	once          sync.Once
+	logger        Logger
+	name          string        // returned by Conn.Listener
+	network, addr string        // network and local address
+	bind          string        // address passed to listen, matches inherited fds
+	tlsConfig     *tls.Config   // tls config of accepted connections
+	proxyProtocol ProxyProtocol // PROXY protocol mode of accepted connections
 }
 
 type udpListener struct {
-	f    *os.File
-	fd   int
-	ln   net.PacketConn
-	once sync.Once
+	f      *os.File
+	fd     int
+	ln     net.PacketConn
+	path   string // unixgram socket file
+	bind   string // address passed to listen, matches inherited fds
+	once   sync.Once
+	logger Logger
+}
+
+func listenTcp(network, addr string, opt *TcpOption) (*tcpListener, error) {
+	var (
+		ln  = &tcpListener{logger: loggerOf(opt.Logger), bind: addr}
+		f   *os.File
+		err error
+	)
+	if f = takeActivated(opt.SystemdSocket); f == nil {
+		f = takeInherited(network, addr)
+	}
+	switch {
+	case f != nil:
+		// 使用systemd或父进程传递的监听
+		ln.ln, err = net.FileListener(f)
+		_ = f.Close()
+	case network == "unix":
+		if err = removeStaleSocket(addr, unix.SOCK_STREAM); err != nil {
+			return nil, err
+		}
+		ln.ln, err = net.Listen(network, addr)
+	case opt.ReusePort:
+		ln.ln, err = internal.ReusePortListen(network, addr)
+	default:
+		ln.ln, err = net.Listen(network, addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if network == "unix" && opt.SocketPerm != 0 && f == nil {
+		if err = os.Chmod(addr, opt.SocketPerm); err != nil {
+			ln.close()
+			return nil, err
+		}
+	}
+	if err = ln.initFd(); err != nil {
+		return nil, err
+	}
+	ln.network = ln.ln.Addr().Network()
+	ln.addr = ln.ln.Addr().String()
+	ln.name = ln.addr
+	ln.tlsConfig = opt.TLSConfig
+	ln.proxyProtocol = opt.ProxyProtocol
+	return ln, nil
+}
+
+func listenUdp(network, addr string, opt *UdpOption) (*udpListener, error) {
+	var (
+		ln  = &udpListener{logger: loggerOf(opt.Logger), bind: addr}
+		f   *os.File
+		err error
+	)
+	if f = takeActivated(opt.SystemdSocket); f == nil {
+		f = takeInherited(network, addr)
+	}
+	switch {
+	case f != nil:
+		// 使用systemd或父进程传递的监听
+		ln.ln, err = net.FilePacketConn(f)
+		_ = f.Close()
+	case network == "unixgram":
+		if err = removeStaleSocket(addr, unix.SOCK_DGRAM); err != nil {
+			return nil, err
+		}
+		ln.ln, err = net.ListenPacket(network, addr)
+	case opt.ReusePort:
+		ln.ln, err = internal.ReusePortListenPacket(network, addr)
+	default:
+		ln.ln, err = net.ListenPacket(network, addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if network == "unixgram" && f == nil {
+		ln.path = addr
+		if opt.SocketPerm != 0 {
+			if err = os.Chmod(addr, opt.SocketPerm); err != nil {
+				ln.close()
+				return nil, err
+			}
+		}
+	}
+	if err = ln.initFd(); err != nil {
+		return nil, err
+	}
+	return ln, nil
+}
+
+// 删除残留的socket文件，仍有进程在监听时返回错误
+// sotype为将要创建的监听的类型，以相同类型连接探测，只有ECONNREFUSED表示无进程监听
+func removeStaleSocket(path string, sotype int) error {
+	// 抽象socket没有对应的文件
+	if len(path) == 0 || path[0] == '@' {
+		return nil
+	}
+	var fi, err = os.Stat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		return ErrNotSocketFile
+	}
+	var fd int
+	if fd, err = unix.Socket(unix.AF_UNIX, sotype|unix.SOCK_CLOEXEC, 0); err != nil {
+		return err
+	}
+	err = unix.Connect(fd, &unix.SockaddrUnix{Name: path})
+	_ = unix.Close(fd)
+	switch {
+	case err == nil, errors.Is(err, unix.EPROTOTYPE):
+		// 有进程监听，EPROTOTYPE为其他类型的socket
+		return ErrSocketInUse
+	case errors.Is(err, unix.ECONNREFUSED):
+		return os.Remove(path)
+	default:
+		return err
+	}
 }
 
 func (ln *tcpListener) initFd() error {
 	var err error
-	if ln.f, err = ln.ln.(*net.TCPListener).File(); err != nil {
+	switch l := ln.ln.(type) {
+	case *net.TCPListener:
+		ln.f, err = l.File()
+	case *net.UnixListener:
+		ln.f, err = l.File()
+	default:
+		err = ErrUnSupportProtocol
+	}
+	if err != nil {
 		ln.close()
 		return err
 	}
@@ -37,10 +177,14 @@ func (ln *udpListener) initFd() error {
 	switch pconn := ln.ln.(type) {
 	case *net.UDPConn:
 		ln.f, err = pconn.File()
+	case *net.UnixConn:
+		ln.f, err = pconn.File()
+	default:
+		err = ErrUnSupportProtocol
 	}
 	if err != nil {
 		ln.close()
-		panic(err)
+		return err
 	}
 	ln.fd = int(ln.f.Fd())
 	// 设置非阻塞
@@ -52,12 +196,18 @@ func (ln *udpListener) close() {
 		var err error
 		if ln.f != nil {
 			if err = ln.f.Close(); err != nil {
-				defaultLogger.Printf("udpListener fd close error: %v\n", err)
+				ln.logger.Error("failed to close listener file", "network", "udp", "fd", ln.fd, "error", err)
 			}
 		}
 		if ln.ln != nil {
 			if err = ln.ln.Close(); err != nil {
-				defaultLogger.Printf("udpListener fd close error: %v\n", err)
+				ln.logger.Error("failed to close listener", "network", "udp", "addr", ln.ln.LocalAddr(), "error", err)
+			}
+		}
+		// 数据报socket关闭时不会自动删除socket文件
+		if ln.path != "" && ln.path[0] != '@' {
+			if err = os.Remove(ln.path); err != nil && !os.IsNotExist(err) {
+				ln.logger.Error("failed to remove socket file", "path", ln.path, "error", err)
 			}
 		}
 	})
@@ -68,12 +218,12 @@ func (ln *tcpListener) close() {
 		var err error
 		if ln.f != nil {
 			if err = ln.f.Close(); err != nil {
-				defaultLogger.Printf("tcpListener fd close error: %v\n", err)
+				ln.logger.Error("failed to close listener file", "network", "tcp", "fd", ln.fd, "error", err)
 			}
 		}
 		if ln.ln != nil {
 			if err = ln.ln.Close(); err != nil {
-				defaultLogger.Printf("tcpListener fd close error : %v\n", err)
+				ln.logger.Error("failed to close listener", "network", "tcp", "addr", ln.ln.Addr(), "error", err)
 			}
 		}
 	})
@@ -1,5 +1,92 @@
 package cnet
 
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+// Logger 分级的结构化日志，kv为交替的键值对，如 "loop", 0, "fd", 12
 type Logger interface {
+	Debug(msg string, kv ...interface{})
+	Info(msg string, kv ...interface{})
+	Warn(msg string, kv ...interface{})
+	Error(msg string, kv ...interface{})
+}
+
+// Printfer 兼容log.Logger等Printf风格的日志
+type Printfer interface {
 	Printf(format string, args ...interface{})
 }
+
+// Level 日志级别
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "DEBUG"
+	case LevelInfo:
+		return "INFO"
+	case LevelWarn:
+		return "WARN"
+	case LevelError:
+		return "ERROR"
+	default:
+		return fmt.Sprintf("LEVEL(%d)", int(l))
+	}
+}
+
+var defaultLogger = NewPrintfLogger(log.New(os.Stderr, "[service] - ", log.LstdFlags), LevelInfo)
+
+// 未配置Logger时使用默认日志
+func loggerOf(l Logger) Logger {
+	if l == nil {
+		return defaultLogger
+	}
+	return l
+}
+
+type printfLogger struct {
+	p     Printfer
+	level Level
+}
+
+// NewPrintfLogger 将Printf风格的日志适配为Logger，低于level的日志被丢弃
+// 输出格式为: [LEVEL] msg key=value key=value
+func NewPrintfLogger(p Printfer, level Level) Logger {
+	return &printfLogger{p: p, level: level}
+}
+
+func (l *printfLogger) Debug(msg string, kv ...interface{}) { l.log(LevelDebug, msg, kv) }
+func (l *printfLogger) Info(msg string, kv ...interface{})  { l.log(LevelInfo, msg, kv) }
+func (l *printfLogger) Warn(msg string, kv ...interface{})  { l.log(LevelWarn, msg, kv) }
+func (l *printfLogger) Error(msg string, kv ...interface{}) { l.log(LevelError, msg, kv) }
+
+func (l *printfLogger) log(level Level, msg string, kv []interface{}) {
+	if level < l.level {
+		return
+	}
+	var b strings.Builder
+	b.WriteString("[")
+	b.WriteString(level.String())
+	b.WriteString("] ")
+	b.WriteString(msg)
+	for i := 0; i < len(kv); i += 2 {
+		b.WriteString(" ")
+		if i+1 < len(kv) {
+			fmt.Fprintf(&b, "%v=%v", kv[i], kv[i+1])
+		} else {
+			fmt.Fprintf(&b, "!BADKEY=%v", kv[i])
+		}
+	}
+	l.p.Printf("%s", b.String())
+}
@@ -0,0 +1,16 @@
+//go:build go1.21
+// +build go1.21
+
+package cnet
+
+import (
+	"log/slog"
+)
+
+// NewSlogLogger 将log/slog适配为Logger，*slog.Logger的Debug/Info/Warn/Error已满足Logger，直接使用即可
+func NewSlogLogger(l *slog.Logger) Logger {
+	if l == nil {
+		return slog.Default()
+	}
+	return l
+}
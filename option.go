@@ -1,16 +1,97 @@
 package cnet
 
-import "time"
+import (
+	"crypto/tls"
+	"os"
+	"time"
+)
+
+// OverflowPolicy 待发送数据超过WriteBufferLimit时的处理方式
+type OverflowPolicy int
+
+const (
+	// AsyncWrite返回ErrWriteBufferFull并丢弃数据，回调返回的数据直接丢弃
+	OverflowError OverflowPolicy = iota
+	// 丢弃数据
+	OverflowDrop
+	// 关闭连接，OnConnClosed收到ErrWriteBufferFull
+	OverflowClose
+)
 
 type TcpOption struct {
 	ReusePort    bool
 	MultiCore    int
 	Logger       Logger
 	TcpKeepAlive time.Duration
+	// unix socket文件权限，为0时不修改
+	SocketPerm os.FileMode
+	// 连接在该时间内没有任何读写时关闭
+	IdleTimeout time.Duration
+	// 连接在该时间内没有收到数据时关闭
+	ReadTimeout time.Duration
+	// 待发送数据在该时间内没有写出任何字节时关闭
+	WriteTimeout time.Duration
+	// 客户端连接超时时间
+	ConnectTimeout time.Duration
+	// 待发送数据超过高水位时回调OnBackpressure，回落至低水位时回调OnWritable，为0时不检查
+	WriteBufferHighWatermark int
+	WriteBufferLowWatermark  int
+	// 待发送数据的上限，为0时不限制。待发送数据为空时单次写入不受限制
+	WriteBufferLimit int
+	// 超过WriteBufferLimit时的处理方式
+	WriteBufferPolicy OverflowPolicy
+	// 编解码器，设置后每解出一个完整的帧回调一次ConnHandler，回调返回的数据会先编码再写入
+	Codec ICodec
+	// 设置后accept的连接先完成TLS握手再回调OnConnOpened，收发的数据自动解密与加密
+	// 每个握手中的连接使用一个goroutine执行握手，握手完成后回到event-loop，建议同时设置ReadTimeout限制握手时间
+	TLSConfig *tls.Config
+	// 是否解析accept的连接开头的HAProxy PROXY protocol v1/v2头，解析后覆盖RemoteAddr与LocalAddr
+	ProxyProtocol ProxyProtocol
+	// 等待PROXY头的超时时间，默认5秒
+	ProxyHeaderTimeout time.Duration
+	// 最大连接数，为0时不限制
+	MaxConnections int
+	// 单个IP的最大连接数，为0时不限制
+	MaxConnectionsPerIP int
+	// 每个来源每秒允许accept的连接数，为0时不限制，AcceptBurst为令牌桶容量，默认1
+	AcceptRate  float64
+	AcceptBurst int
+	// 限制accept速率时按该前缀长度将IP归为同一来源，默认32与128即单个IP
+	AcceptRateIPv4Prefix int
+	AcceptRateIPv6Prefix int
+	// 超过连接数或速率限制拒绝连接时关闭前写入的数据
+	RejectMessage []byte
+	// 来源IP访问控制，为nil时不限制
+	AccessControl *AccessControl
+	// 未开启ReusePort时主reactor与Client.Dial为新连接选择event-loop的策略，默认RoundRobin
+	LoadBalancing LoadBalancing
+	// 自定义event-loop选择，设置后忽略LoadBalancing
+	LoadBalancer LoadBalancer
+	// systemd socket activation传递的socket名称(FileDescriptorName)，存在时使用该socket而不监听地址
+	// MultiService使用ListenerSpec.SystemdSocket
+	SystemdSocket string
+	// 服务启动后通过NOTIFY_SOCKET通知systemd READY=1，关闭时通知STOPPING=1
+	SystemdNotify bool
+	// 大于0时ConnHandler在该数量的goroutine中执行，返回的数据与Operation回到event-loop处理
+	// 执行期间停止读取该连接，保证同一连接按序处理，此时ConnHandler中不能调用AfterFunc与Every
+	WorkerPool int
+	// 等待worker执行的ConnHandler数量上限，为0时只交给空闲的worker
+	// 超过上限的连接在event-loop中排队并保持停止读取
+	WorkerQueueSize int
+	// 连接fd使用边缘触发(EPOLLET)，每次事件读写直至EAGAIN，对端半关闭(EPOLLRDHUP)时写完待发送数据后关闭连接
+	EdgeTriggered bool
 }
 
 type UdpOption struct {
 	ReusePort bool
 	MultiCore int
 	Logger    Logger
+	// unixgram socket文件权限，为0时不修改
+	SocketPerm os.FileMode
+	// 来源IP访问控制，不允许的数据包在PackHandler之前丢弃
+	AccessControl *AccessControl
+	// systemd socket activation传递的socket名称(FileDescriptorName)，存在时使用该socket而不监听地址
+	SystemdSocket string
+	// 服务启动后通过NOTIFY_SOCKET通知systemd READY=1，关闭时通知STOPPING=1
+	SystemdNotify bool
 }
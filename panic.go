@@ -0,0 +1,65 @@
+package cnet
+
+import (
+	"runtime/debug"
+)
+
+// IPanicHandler 可选实现，回调(包括WorkerPool中的ConnHandler)或Trigger执行的函数panic时回调OnPanic，在event-loop中执行
+// c为panic所在的连接，该连接会被关闭，udp服务及不属于某个连接时c为nil，event-loop继续运行
+type IPanicHandler interface {
+	OnPanic(c Conn, v interface{}, stack []byte)
+}
+
+// recoverConn 恢复c的回调中的panic，需直接defer调用
+func (el *eventTcpLoop) recoverConn(c *conn) {
+	if v := recover(); v != nil {
+		el.handlePanic(c, v, debug.Stack())
+	}
+}
+
+// handlePanic 记录panic并回调OnPanic，c不为nil时关闭c
+func (el *eventTcpLoop) handlePanic(c *conn, v interface{}, stack []byte) {
+	var (
+		cc     Conn
+		remote string
+	)
+	if c != nil {
+		cc, remote = c, c.remoteAddr
+	}
+	el.srv.logger.Error("callback panic", "loop", el.idx, "remote", remote, "panic", v, "stack", string(stack))
+	if c != nil {
+		safely(el.srv.logger, func() {
+			_ = el.loopCloseConn(c, ErrCallbackPanic)
+		})
+	}
+	if h, ok := el.srv.eventHandler.(IPanicHandler); ok {
+		safely(el.srv.logger, func() {
+			h.OnPanic(cc, v, stack)
+		})
+	}
+}
+
+func (el *eventUdpLoop) recoverPanic() {
+	if v := recover(); v != nil {
+		el.handlePanic(v, debug.Stack())
+	}
+}
+
+func (el *eventUdpLoop) handlePanic(v interface{}, stack []byte) {
+	el.srv.logger.Error("callback panic", "loop", el.idx, "panic", v, "stack", string(stack))
+	if h, ok := el.eventHandler.(IPanicHandler); ok {
+		safely(el.srv.logger, func() {
+			h.OnPanic(nil, v, stack)
+		})
+	}
+}
+
+// safely 执行fn，忽略处理panic期间再次发生的panic
+func safely(logger Logger, fn func()) {
+	defer func() {
+		if v := recover(); v != nil {
+			logger.Error("panic while handling panic", "panic", v)
+		}
+	}()
+	fn()
+}
@@ -0,0 +1,308 @@
+package cnet
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ProxyProtocol 是否解析HAProxy PROXY protocol头
+type ProxyProtocol int
+
+const (
+	// 不解析
+	ProxyProtocolOff ProxyProtocol = iota
+	// 连接以PROXY头开始时解析，否则按普通连接处理
+	ProxyProtocolOptional
+	// 连接必须以PROXY头开始，否则关闭连接
+	ProxyProtocolRequired
+)
+
+// PROXY protocol v2 TLV类型
+const (
+	ProxyTLVALPN      byte = 0x01
+	ProxyTLVAuthority byte = 0x02
+	ProxyTLVCRC32C    byte = 0x03
+	ProxyTLVNoop      byte = 0x04
+	ProxyTLVUniqueID  byte = 0x05
+	ProxyTLVSSL       byte = 0x20
+	ProxyTLVNetNS     byte = 0x30
+)
+
+const (
+	defaultProxyHeaderTimeout = 5 * time.Second
+	// v1头最大长度，包含\r\n
+	maxProxyV1Length = 107
+	proxyV2HeaderLen = 16
+)
+
+var (
+	proxyV1Signature = []byte("PROXY ")
+	proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+// ProxyHeader 连接的PROXY protocol头
+type ProxyHeader struct {
+	// 1或2
+	Version int
+	// LOCAL命令或v1的UNKNOWN，此时地址为nil，连接使用真实地址
+	Local bool
+	// 客户端与代理接收连接的地址
+	SourceAddr, DestinationAddr net.Addr
+	// v2的TLV扩展
+	TLVs []ProxyTLV
+}
+
+type ProxyTLV struct {
+	Type  byte
+	Value []byte
+}
+
+// TLV 返回第一个给定类型的TLV
+func (h *ProxyHeader) TLV(typ byte) ([]byte, bool) {
+	for _, tlv := range h.TLVs {
+		if tlv.Type == typ {
+			return tlv.Value, true
+		}
+	}
+	return nil, false
+}
+
+// parseProxyHeader 从data开头解析PROXY头，返回头与其占用的字节数
+// 数据不足时返回errProxyIncomplete，不是PROXY头时返回nil, 0, nil
+func parseProxyHeader(data []byte) (*ProxyHeader, int, error) {
+	switch {
+	case hasPrefix(data, proxyV2Signature):
+		return parseProxyV2(data)
+	case hasPrefix(data, proxyV1Signature):
+		return parseProxyV1(data)
+	}
+	return nil, 0, nil
+}
+
+// hasPrefix data以sig开头或是sig的前缀时返回true
+func hasPrefix(data, sig []byte) bool {
+	if len(data) < len(sig) {
+		return bytes.HasPrefix(sig, data)
+	}
+	return bytes.HasPrefix(data, sig)
+}
+
+func parseProxyV1(data []byte) (*ProxyHeader, int, error) {
+	var end = bytes.Index(data, []byte("\r\n"))
+	if end < 0 {
+		if len(data) >= maxProxyV1Length {
+			return nil, 0, ErrInvalidProxyHeader
+		}
+		return nil, 0, errProxyIncomplete
+	}
+	if end+2 > maxProxyV1Length {
+		return nil, 0, ErrInvalidProxyHeader
+	}
+	var (
+		fields = strings.Split(string(data[:end]), " ")
+		hdr    = &ProxyHeader{Version: 1}
+	)
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		hdr.Local = true
+		return hdr, end + 2, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, 0, ErrInvalidProxyHeader
+	}
+	var (
+		src, dst         = net.ParseIP(fields[2]), net.ParseIP(fields[3])
+		srcPort, errSrc  = parseProxyPort(fields[4])
+		dstPort, errDest = parseProxyPort(fields[5])
+	)
+	if src == nil || dst == nil || errSrc != nil || errDest != nil {
+		return nil, 0, ErrInvalidProxyHeader
+	}
+	if (src.To4() != nil) != (fields[1] == "TCP4") || (dst.To4() != nil) != (fields[1] == "TCP4") {
+		return nil, 0, ErrInvalidProxyHeader
+	}
+	hdr.SourceAddr = &net.TCPAddr{IP: src, Port: srcPort}
+	hdr.DestinationAddr = &net.TCPAddr{IP: dst, Port: dstPort}
+	return hdr, end + 2, nil
+}
+
+func parseProxyPort(s string) (int, error) {
+	var port, err = strconv.ParseUint(s, 10, 16)
+	// 不允许前导0
+	if err != nil || (len(s) > 1 && s[0] == '0') {
+		return 0, ErrInvalidProxyHeader
+	}
+	return int(port), nil
+}
+
+func parseProxyV2(data []byte) (*ProxyHeader, int, error) {
+	if len(data) < proxyV2HeaderLen {
+		return nil, 0, errProxyIncomplete
+	}
+	var (
+		verCmd = data[12]
+		family = data[13]
+		length = int(binary.BigEndian.Uint16(data[14:16]))
+		total  = proxyV2HeaderLen + length
+		hdr    = &ProxyHeader{Version: 2}
+	)
+	if verCmd>>4 != 2 {
+		return nil, 0, ErrInvalidProxyHeader
+	}
+	if len(data) < total {
+		return nil, 0, errProxyIncomplete
+	}
+	var payload = data[proxyV2HeaderLen:total]
+	switch verCmd & 0x0f {
+	case 0x00:
+		hdr.Local = true
+	case 0x01:
+	default:
+		return nil, 0, ErrInvalidProxyHeader
+	}
+	var addrLen int
+	switch family >> 4 {
+	case 0x1: // AF_INET
+		addrLen = 12
+	case 0x2: // AF_INET6
+		addrLen = 36
+	case 0x3: // AF_UNIX
+		addrLen = 216
+	case 0x0: // AF_UNSPEC
+		hdr.Local = true
+	default:
+		return nil, 0, ErrInvalidProxyHeader
+	}
+	if len(payload) < addrLen {
+		return nil, 0, ErrInvalidProxyHeader
+	}
+	if !hdr.Local {
+		hdr.SourceAddr, hdr.DestinationAddr = proxyV2Addr(family, payload[:addrLen])
+	}
+	var tlvs = payload[addrLen:]
+	for len(tlvs) > 0 {
+		if len(tlvs) < 3 {
+			return nil, 0, ErrInvalidProxyHeader
+		}
+		var n = int(binary.BigEndian.Uint16(tlvs[1:3]))
+		if len(tlvs) < 3+n {
+			return nil, 0, ErrInvalidProxyHeader
+		}
+		var value = make([]byte, n)
+		copy(value, tlvs[3:3+n])
+		hdr.TLVs = append(hdr.TLVs, ProxyTLV{Type: tlvs[0], Value: value})
+		tlvs = tlvs[3+n:]
+	}
+	return hdr, total, nil
+}
+
+func proxyV2Addr(family byte, b []byte) (src, dst net.Addr) {
+	var udp = family&0x0f == 0x2
+	var ipAddr = func(ip []byte, port []byte) net.Addr {
+		var (
+			addr = append(net.IP(nil), ip...)
+			p    = int(binary.BigEndian.Uint16(port))
+		)
+		if udp {
+			return &net.UDPAddr{IP: addr, Port: p}
+		}
+		return &net.TCPAddr{IP: addr, Port: p}
+	}
+	switch family >> 4 {
+	case 0x1:
+		return ipAddr(b[0:4], b[8:10]), ipAddr(b[4:8], b[10:12])
+	case 0x2:
+		return ipAddr(b[0:16], b[32:34]), ipAddr(b[16:32], b[34:36])
+	default:
+		var (
+			network = "unix"
+			path    = func(p []byte) string {
+				if i := bytes.IndexByte(p, 0); i >= 0 {
+					p = p[:i]
+				}
+				return string(p)
+			}
+		)
+		if udp {
+			network = "unixgram"
+		}
+		return &net.UnixAddr{Name: path(b[:108]), Net: network}, &net.UnixAddr{Name: path(b[108:216]), Net: network}
+	}
+}
+
+// 开始等待PROXY头，Required模式下超时关闭连接，Optional模式下超时按普通连接处理
+func (el *eventTcpLoop) startProxyTimer(c *conn) {
+	var timeout = el.srv.opt.ProxyHeaderTimeout
+	if timeout <= 0 {
+		timeout = defaultProxyHeaderTimeout
+	}
+	c.proxyPending = true
+	c.proxyTimer = el.timers.AfterFunc(timeout, func() error {
+		defer el.recoverConn(c)
+		c.proxyTimer = nil
+		if c.ln.proxyProtocol == ProxyProtocolRequired {
+			return el.loopCloseConn(c, ErrProxyHeaderTimeout)
+		}
+		// 服务端先发送数据的协议，客户端在收到数据前不会发送任何内容
+		c.proxyPending = false
+		return el.loopProxyDone(c)
+	})
+}
+
+// loopReadProxy 解析PROXY头，完成后继续TLS握手或打开连接
+func (el *eventTcpLoop) loopReadProxy(c *conn, data []byte) error {
+	c.inBuf.Write(data)
+	var (
+		_, buf      = c.Read()
+		hdr, n, err = parseProxyHeader(buf)
+	)
+	switch {
+	case err == errProxyIncomplete:
+		return nil
+	case err != nil:
+		return el.loopCloseConn(c, err)
+	case hdr == nil && c.ln.proxyProtocol == ProxyProtocolRequired:
+		return el.loopCloseConn(c, ErrInvalidProxyHeader)
+	}
+	c.proxyPending = false
+	if c.proxyTimer != nil {
+		el.timers.Remove(c.proxyTimer)
+		c.proxyTimer = nil
+	}
+	if hdr != nil {
+		c.inBuf.Shift(n)
+		c.proxy = hdr
+		if !hdr.Local && hdr.SourceAddr != nil {
+			c.remoteAddr = hdr.SourceAddr.String()
+			c.localAddr = hdr.DestinationAddr.String()
+		}
+	}
+	return el.loopProxyDone(c)
+}
+
+// loopProxyDone PROXY头处理完成，继续TLS握手或打开连接，并处理已收到的数据
+func (el *eventTcpLoop) loopProxyDone(c *conn) error {
+	if err := el.loopEstablish(c); err != nil || el.connections[c.fd] != c {
+		return err
+	}
+	// PROXY头之后的数据
+	if c.inBuf.IsEmpty() {
+		return nil
+	}
+	if c.tls != nil {
+		var _, buf = c.Read()
+		c.inBuf.Reset()
+		return el.loopReadTLS(c, buf)
+	}
+	if !c.opened {
+		return nil
+	}
+	return el.loopHandle(c)
+}
+
+func (c *conn) ProxyHeader() *ProxyHeader {
+	return c.proxy
+}
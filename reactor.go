@@ -1,16 +1,19 @@
 package cnet
 
 import (
-	"github.com/cuckooemm/cnet/internal/netpoll"
 	"golang.org/x/sys/unix"
 )
 
 func (srv *tcpServer) activateMainReactor() {
+	defer enterLoop(srv)()
 	defer srv.signalShutdown()
 
-	srv.logger.Printf("main reactor exits with error:%v\n", srv.mainLoop.poller.Polling(func(fd int, ev uint32) error {
+	var err = srv.mainLoop.poller.Polling(func(fd int, ev uint32) error {
+		// OnConnRejected与LoadBalancer中的panic
+		defer srv.mainLoop.recoverConn(nil)
 		return srv.acceptNewConnection(fd)
-	}))
+	})
+	srv.logger.Info("main reactor exits", "error", err)
 }
 
 func (srv *tcpServer) acceptNewConnection(fd int) error {
@@ -27,39 +30,35 @@ func (srv *tcpServer) acceptNewConnection(fd int) error {
 		return err
 	}
 	if err = unix.SetNonblock(cfd, true); err != nil {
+		_ = unix.Close(cfd)
+		return err
+	}
+	var ip, ok = srv.admit(cfd, sa)
+	if !ok {
+		return nil
+	}
+	el = srv.subLoopGroup.next(sa)
+	var conn = newTCPConn(cfd, el, sa, srv.listener(fd))
+	conn.limitIP, conn.limited = ip, srv.limiter != nil
+	if err = el.poller.Trigger(func() error {
+		// loopAccepted计入连接数之后再减去待注册数，避免选择时少计
+		defer el.assigned()
+		return el.loopAccepted(conn)
+	}); err != nil {
+		// event-loop已关闭
+		el.assigned()
+		_ = unix.Close(cfd)
+		el.releaseLimit(conn)
+		conn.releaseTCP()
 		return err
 	}
-	el = srv.subLoopGroup.next()
-	var conn = newTCPConn(cfd, el, sa)
-	_ = el.poller.Trigger(func() (err error) {
-		if err = el.poller.AddRead(cfd); err != nil {
-			return
-		}
-		el.connections[cfd] = conn
-		err = el.loopOpen(conn)
-		return
-	})
 	return nil
 }
 
 func (srv *tcpServer) activateSubReactor(el *eventTcpLoop) {
+	defer enterLoop(srv)()
 	defer srv.signalShutdown()
 
-	srv.logger.Printf("event-loop:%d exits with error:%v\n", el.idx, el.poller.Polling(func(fd int, ev uint32) error {
-		if c, ack := el.connections[fd]; ack {
-			switch c.outBuf.IsEmpty() {
-			case false:
-				if ev&netpoll.OutEvents != 0 {
-					return el.loopWrite(c)
-				}
-				return nil
-			case true:
-				if ev&netpoll.InEvents != 0 {
-					return el.loopRead(c)
-				}
-				return nil
-			}
-		}
-		return nil
-	}))
+	var err = el.poller.Polling(el.handleEvent)
+	srv.logger.Info("event-loop exits", "loop", el.idx, "error", err)
 }
@@ -0,0 +1,125 @@
+package cnet
+
+import (
+	"bytes"
+	"io"
+)
+
+// connReader 入站缓冲区的io.Reader视图
+type connReader struct {
+	c *conn
+}
+
+func (r *connReader) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if r.c.inBuf.IsEmpty() {
+		return 0, io.EOF
+	}
+	return r.c.inBuf.Read(p)
+}
+
+func (r *connReader) ReadByte() (byte, error) {
+	return r.c.ReadByte()
+}
+
+// WriteTo 将缓冲区中的数据直接写入w，不经过中间缓冲区
+func (r *connReader) WriteTo(w io.Writer) (n int64, err error) {
+	var head, tail = r.c.inBuf.LazyReadAll()
+	for _, b := range [2][]byte{head, tail} {
+		if len(b) == 0 {
+			continue
+		}
+		var m int
+		m, err = w.Write(b)
+		r.c.inBuf.Shift(m)
+		n += int64(m)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (c *conn) Peek(n int) [][]byte {
+	var head, tail []byte
+	if n <= 0 {
+		head, tail = c.inBuf.LazyReadAll()
+	} else if c.inBuf.Length() >= n {
+		head, tail = c.inBuf.LazyRead(n)
+	}
+	if head == nil {
+		return nil
+	}
+	c.peek[0], c.peek[1] = head, tail
+	if tail == nil {
+		return c.peek[:1]
+	}
+	return c.peek[:2]
+}
+
+func (c *conn) Discard(n int) int {
+	if l := c.inBuf.Length(); n > l {
+		n = l
+	}
+	if n <= 0 {
+		return 0
+	}
+	c.inBuf.Shift(n)
+	return n
+}
+
+func (c *conn) Next(n int) []byte {
+	if n <= 0 || c.inBuf.Length() < n {
+		return nil
+	}
+	var b = c.join(c.inBuf.LazyRead(n))
+	c.inBuf.Shift(n)
+	return b
+}
+
+func (c *conn) ReadByte() (byte, error) {
+	if c.inBuf.IsEmpty() {
+		return 0, io.EOF
+	}
+	return c.inBuf.ReadByte()
+}
+
+func (c *conn) Until(delim byte) []byte {
+	var (
+		head, tail = c.inBuf.LazyReadAll()
+		n          int
+	)
+	if i := bytes.IndexByte(head, delim); i >= 0 {
+		head, tail = head[:i+1], nil
+		n = i + 1
+	} else if i = bytes.IndexByte(tail, delim); i >= 0 {
+		tail = tail[:i+1]
+		n = len(head) + i + 1
+	} else {
+		return nil
+	}
+	var b = c.join(head, tail)
+	c.inBuf.Shift(n)
+	return b
+}
+
+func (c *conn) Reader() io.Reader {
+	return &c.reader
+}
+
+// join 连接head与tail，tail为nil时直接返回head，否则复制到复用的scratch中
+func (c *conn) join(head, tail []byte) []byte {
+	if tail == nil {
+		return head
+	}
+	var n = len(head) + len(tail)
+	if cap(c.scratch) < n {
+		c.scratch = make([]byte, n)
+	}
+	var b = c.scratch[:n]
+	copy(b, head)
+	copy(b[len(head):], tail)
+	return b
+}
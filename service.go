@@ -1,40 +1,93 @@
 package cnet
 
 import (
+	"context"
 	"github.com/cuckooemm/cnet/internal/netpoll"
-	"log"
+	"github.com/cuckooemm/cnet/internal/workerpool"
+	"golang.org/x/sys/unix"
 	"os"
 	"os/signal"
 	"runtime"
 	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 )
 
-var defaultLogger = Logger(log.New(os.Stderr, "[service] - ", log.LstdFlags))
+const (
+	drainInterval   = 10 * time.Millisecond // interval of checking outBuf when shutdown
+	shutdownTimeout = 5 * time.Second       // wait for outBuf to be written when interrupted
+)
 
 type tcpServer struct {
-	ln                 *tcpListener
+	lns                []*tcpListener
 	wg                 sync.WaitGroup // event-loop close WaitGroup
 	opt                *TcpOption     // options with server
 	once               sync.Once      // make sure only signalShutdown once
-	cond               *sync.Cond     // shutdown signaler
+	drainOnce          sync.Once      // make sure only stop accepting and drain once
+	shutdown           chan struct{}  // closed when the server is going to be shutdown
+	done               chan struct{}  // closed when the server is completely stopped
 	logger             Logger         // customized logger for logging info
 	network, localAddr string         // network and local address
 	loop               *eventTcpLoop  // main loop for accepting connections
 	mainLoop           *eventTcpLoop
-	eventHandler       IEventCallback     // user eventHandler
+	eventHandler       TcpEventHandler    // user eventHandler
 	subLoopGroup       IEventTcpLoopGroup // loops for handling events
+	limiter            *acceptLimiter     // connection limits, nil if not set
+	workers            *workerpool.Pool   // pool running ConnHandler, nil if WorkerPool is not set
 }
 type udpServer struct {
 	ln                 *udpListener
 	wg                 sync.WaitGroup // event-loop close WaitGroup
 	opt                *UdpOption     // options with server
 	once               sync.Once      // make sure only signalShutdown once
-	cond               *sync.Cond     // shutdown signaler
+	shutdown           chan struct{}  // closed when the server is going to be shutdown
+	done               chan struct{}  // closed when the server is completely stopped
 	logger             Logger         // customized logger for logging info
 	network, localAddr string         // network and local address
 	loop               *eventUdpLoop
 	loopGroup          []*eventUdpLoop
-	eventHandler       IEventCallback // user eventHandler
+	eventHandler       UdpEventHandler // user eventHandler
+}
+
+// loopThreads event-loop与serve goroutine锁定的线程id -> 所属服务，用于判断调用是否来自回调，回调中不能阻塞等待event-loop
+// goroutine锁定线程期间其他goroutine不会在该线程上执行，当前线程已记录即为event-loop或serve
+var loopThreads sync.Map
+
+// enterLoop 在event-loop或serve goroutine开始时调用，锁定并记录当前线程，返回的函数在goroutine退出时调用
+func enterLoop(srv interface{}) (exit func()) {
+	runtime.LockOSThread()
+	var tid = unix.Gettid()
+	loopThreads.Store(tid, srv)
+	return func() {
+		loopThreads.Delete(tid)
+		runtime.UnlockOSThread()
+	}
+}
+
+// workerThread 记录在loopThreads中的worker线程，worker中可以阻塞Dial，但不能等待服务关闭
+type workerThread struct {
+	srv interface{}
+}
+
+// enterWorker 在worker goroutine开始时调用，与enterLoop相同
+func enterWorker(srv interface{}) (exit func()) {
+	return enterLoop(workerThread{srv: srv})
+}
+
+// inLoop 当前goroutine是否为srv的event-loop或serve，srv为nil时判断是否为任意服务的
+func inLoop(srv interface{}) bool {
+	var owner, ok = loopThreads.Load(unix.Gettid())
+	if _, worker := owner.(workerThread); !ok || worker {
+		return false
+	}
+	return srv == nil || owner == srv
+}
+
+// inCallback 当前goroutine是否为srv的event-loop、serve或worker，其中等待服务关闭会死锁
+func inCallback(srv interface{}) bool {
+	var owner, ok = loopThreads.Load(unix.Gettid())
+	return ok && (owner == srv || owner == workerThread{srv: srv})
 }
 
 // 开启服务
@@ -46,39 +99,61 @@ func (srv *tcpServer) start(core int) error {
 	return srv.initReactors(core)
 }
 
-// 等待服务关闭
-func (srv *tcpServer) wait() {
-	go srv.signalHandler()
-	// Wait on a signal for shutdown
-	srv.waitForShutdown()
+// 等待关闭信号后关闭服务
+func (srv *tcpServer) serve() {
+	defer enterLoop(srv)()
+	<-srv.shutdown
+	sdNotify(srv.opt.SystemdNotify, srv.logger, "STOPPING=1")
+	srv.eventHandler.OnShutdown(srv)
+	srv.stop()
+}
+
+func (srv *tcpServer) stop() {
 	var err error
 	// 通知loop关闭监听
 	srv.subLoopGroup.iterate(func(el *eventTcpLoop) bool {
 		if err = el.poller.Trigger(func() error {
 			return ErrServerShutdown
 		}); err != nil {
-			srv.logger.Printf("failed to close %d event-loop. err : %v\n", el.idx, err)
+			srv.logger.Error("failed to close event-loop", "loop", el.idx, "error", err)
 		}
 		return true
 	})
 
+	for _, ln := range srv.lns {
+		ln.close()
+	}
 	if srv.mainLoop != nil {
-		srv.ln.close()
 		if err = srv.mainLoop.poller.Trigger(func() error {
 			return ErrServerShutdown
 		}); err != nil {
-			srv.logger.Printf("failed to close main-loop. err : %v\n", err)
+			srv.logger.Error("failed to close main-loop", "error", err)
 		}
 	}
 
 	// Wait on all loops to complete reading events
 	srv.wg.Wait()
 
+	// 等待worker执行完ConnHandler，worker返回的结果在loop退出后不再处理
+	if srv.workers != nil {
+		srv.workers.Close()
+	}
+
 	// Close loops and all outstanding connections
 	srv.subLoopGroup.iterate(func(el *eventTcpLoop) bool {
+		el.waiting = nil
 		for _, c := range el.connections {
+			if c.working {
+				el.finishWork(c)
+				if err := el.loopDeferred(c); err != nil {
+					srv.logger.Debug("deferred callback returned error on shutdown", "loop", el.idx, "remote", c.remoteAddr, "error", err)
+				}
+				if el.connections[c.fd] != c {
+					continue
+				}
+			}
 			if err := el.loopCloseConn(c, nil); err != nil {
-				srv.logger.Printf("failed to close connection %s\n", c.remoteAddr)
+				srv.logger.Error("failed to close connection", "loop", el.idx, "fd", c.fd, "remote", c.remoteAddr, "error", err)
 			}
 		}
 		return true
@@ -87,29 +162,176 @@ func (srv *tcpServer) wait() {
 
 	if srv.mainLoop != nil {
 		if err = srv.mainLoop.poller.Close(); err != nil {
-			srv.logger.Printf("failed to close main-loop poller,err : %v\n", err)
+			srv.logger.Error("failed to close main-loop poller", "error", err)
+		}
+	}
+	close(srv.done)
+}
+
+func (srv *tcpServer) Shutdown(ctx context.Context) (err error) {
+	// event-loop、worker与OnShutdown中无法等待关闭完成，异步关闭
+	if inCallback(srv) {
+		select {
+		case <-srv.shutdown:
+		default:
+			go func() { _ = srv.Shutdown(ctx) }()
+		}
+		return nil
+	}
+	srv.drainOnce.Do(func() {
+		srv.stopAccept(ctx)
+		err = srv.drain(ctx)
+	})
+	srv.signalShutdown()
+	<-srv.done
+	return
+}
+
+func (srv *tcpServer) Wait() {
+	if !inCallback(srv) {
+		<-srv.done
+	}
+}
+
+func (srv *tcpServer) Network() string   { return srv.network }
+func (srv *tcpServer) LocalAddr() string { return srv.localAddr }
+
+// 从poller中移除监听fd并关闭监听
+func (srv *tcpServer) stopAccept(ctx context.Context) {
+	var unregister = func(el *eventTcpLoop) {
+		srv.runInLoop(ctx, el, func() {
+			for _, ln := range srv.lns {
+				if err := el.poller.Delete(ln.fd); err != nil {
+					srv.logger.Error("failed to delete listener fd from event-loop", "loop", el.idx, "fd", ln.fd, "error", err)
+				}
+			}
+		})
+	}
+	if srv.mainLoop != nil {
+		unregister(srv.mainLoop)
+	} else {
+		srv.subLoopGroup.iterate(func(el *eventTcpLoop) bool {
+			unregister(el)
+			return true
+		})
+	}
+	for _, ln := range srv.lns {
+		ln.close()
+	}
+}
+
+// listener 返回fd对应的监听，不是监听fd时返回nil
+func (srv *tcpServer) listener(fd int) *tcpListener {
+	for _, ln := range srv.lns {
+		if ln.fd == fd {
+			return ln
+		}
+	}
+	return nil
+}
+
+// addListeners 将全部监听fd注册到event-loop
+func (srv *tcpServer) addListeners(el *eventTcpLoop) error {
+	for _, ln := range srv.lns {
+		if err := el.poller.AddRead(ln.fd); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 等待全部连接的outBuf写完，ctx结束时返回ctx.Err()
+func (srv *tcpServer) drain(ctx context.Context) error {
+	var ticker = time.NewTicker(drainInterval)
+	defer ticker.Stop()
+	for {
+		var pending int64
+		srv.subLoopGroup.iterate(func(el *eventTcpLoop) bool {
+			srv.runInLoop(ctx, el, func() {
+				for _, c := range el.connections {
+					if !c.outBuf.IsEmpty() {
+						atomic.AddInt64(&pending, 1)
+					}
+				}
+			})
+			return true
+		})
+		if atomic.LoadInt64(&pending) == 0 {
+			return nil
 		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-srv.shutdown:
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// 在event-loop goroutine中执行fn并等待其完成，服务已关闭或ctx结束时立即返回，不能在event-loop中调用
+func (srv *tcpServer) runInLoop(ctx context.Context, el *eventTcpLoop, fn func()) {
+	var finish = make(chan struct{})
+	if err := el.poller.Trigger(func() error {
+		fn()
+		close(finish)
+		return nil
+	}); err != nil {
+		return
 	}
+	select {
+	case <-finish:
+	case <-srv.shutdown:
+	case <-ctx.Done():
+	}
+}
+
+// 等待关闭信号后关闭服务
+func (srv *udpServer) serve() {
+	defer enterLoop(srv)()
+	<-srv.shutdown
+	sdNotify(srv.opt.SystemdNotify, srv.logger, "STOPPING=1")
+	srv.eventHandler.OnShutdown(srv)
+	srv.stop()
 }
 
 func (srv *udpServer) stop() {
-	// Wait on a signal for shutdown
-	srv.waitForShutdown()
 	var err error
 	// 通知loop关闭监听
 	for _, loop := range srv.loopGroup {
 		if err = loop.poller.Trigger(func() error {
 			return ErrServerShutdown
 		}); err != nil {
-			srv.logger.Printf("failed to close %d event-loop. err : %v\n", loop.idx, err)
+			srv.logger.Error("failed to close event-loop", "loop", loop.idx, "error", err)
 		}
 	}
 	// Wait on all loops to complete reading events
 	srv.wg.Wait()
 
 	srv.closeLoops()
+	srv.ln.close()
+	close(srv.done)
+}
+
+func (srv *udpServer) Shutdown(_ context.Context) error {
+	srv.signalShutdown()
+	// event-loop与OnShutdown中无法等待关闭完成
+	if inCallback(srv) {
+		return nil
+	}
+	<-srv.done
+	return nil
+}
+
+func (srv *udpServer) Wait() {
+	if !inCallback(srv) {
+		<-srv.done
+	}
 }
 
+func (srv *udpServer) Network() string   { return srv.network }
+func (srv *udpServer) LocalAddr() string { return srv.localAddr }
+
 func (srv *tcpServer) initLoops(core int) error {
 	for i := 0; i < core; i++ {
 		var (
@@ -120,16 +342,9 @@ func (srv *tcpServer) initLoops(core int) error {
 		if pr, err = netpoll.CreatePoller(); err != nil {
 			return err
 		}
-		el = &eventTcpLoop{
-			idx:          i,
-			srv:          srv,
-			poller:       pr,
-			buffer:       make([]byte, 0x10000), // 65536
-			connections:  make(map[int]*conn, 16),
-			eventHandler: srv.eventHandler,
-		}
+		el = srv.newEventLoop(i, pr)
 		// event-loop监听同一fd 监听fd事件到达时会唤醒全部
-		if err = el.poller.AddRead(srv.ln.fd); err != nil {
+		if err = srv.addListeners(el); err != nil {
 			return err
 		}
 		srv.subLoopGroup.register(el)
@@ -138,8 +353,34 @@ func (srv *tcpServer) initLoops(core int) error {
 	return nil
 }
 
+func (srv *tcpServer) newEventLoop(idx int, pr *netpoll.Poller) *eventTcpLoop {
+	var el = &eventTcpLoop{
+		idx:          idx,
+		srv:          srv,
+		poller:       pr,
+		buffer:       make([]byte, 0x10000), // 65536
+		connections:  make(map[int]*conn, 16),
+		eventHandler: srv.eventHandler,
+		wheel:        newTimeoutWheel(srv.opt),
+	}
+	// 第一个event-loop负责OnTick回调
+	if t, ok := srv.eventHandler.(ITicker); ok && idx == 0 {
+		el.tick = el.timers.AfterFunc(0, func() error {
+			return el.loopTick(t)
+		})
+	}
+	pr.SetTimer(el)
+	pr.SetLogger(srv.logger)
+	if srv.opt.EdgeTriggered {
+		pr.SetEdgeTriggered()
+	}
+	pr.SetPanicHandler(func(v interface{}, stack []byte) {
+		el.handlePanic(nil, v, stack)
+	})
+	return el
+}
+
 func (srv *udpServer) initLoops(core int) error {
-	srv.wg.Add(core)
 	for i := 0; i < core; i++ {
 		var (
 			pr  *netpoll.Poller
@@ -156,10 +397,14 @@ func (srv *udpServer) initLoops(core int) error {
 			buffer:       make([]byte, 0x10000), // 65536
 			eventHandler: srv.eventHandler,
 		}
+		pr.SetLogger(srv.logger)
+		pr.SetPanicHandler(el.handlePanic)
 		// event-loop监听同一fd 监听fd事件到达时会唤醒全部
 		if err = el.poller.AddRead(srv.ln.fd); err != nil {
 			return err
 		}
+		srv.loopGroup = append(srv.loopGroup, el)
+		srv.wg.Add(1)
 		go func(el *eventUdpLoop) {
 			el.loopRun()
 			srv.wg.Done()
@@ -186,15 +431,7 @@ func (srv *tcpServer) initReactors(numEventLoop int) error {
 			err error
 		)
 		if pr, err = netpoll.CreatePoller(); err == nil {
-			el := &eventTcpLoop{
-				idx:          i,
-				srv:          srv,
-				poller:       pr,
-				buffer:       make([]byte, 0x10000), // 65536
-				connections:  make(map[int]*conn),
-				eventHandler: srv.eventHandler,
-			}
-			srv.subLoopGroup.register(el)
+			srv.subLoopGroup.register(srv.newEventLoop(i, pr))
 		} else {
 			return err
 		}
@@ -214,7 +451,11 @@ func (srv *tcpServer) initReactors(numEventLoop int) error {
 		poller: pr,
 		srv:    srv,
 	}
-	if err = el.poller.AddRead(srv.ln.fd); err != nil {
+	pr.SetLogger(srv.logger)
+	pr.SetPanicHandler(func(v interface{}, stack []byte) {
+		el.handlePanic(nil, v, stack)
+	})
+	if err = srv.addListeners(el); err != nil {
 		return err
 	}
 	srv.mainLoop = el
@@ -240,7 +481,7 @@ func (srv *tcpServer) startReactors() {
 func (srv *tcpServer) closeLoops() {
 	srv.subLoopGroup.iterate(func(loop *eventTcpLoop) bool {
 		if err := loop.poller.Close(); err != nil {
-			srv.logger.Printf("closeLoops idx = %d error : %s\n", loop.idx, err.Error())
+			srv.logger.Error("failed to close event-loop poller", "loop", loop.idx, "error", err)
 		}
 		return true
 	})
@@ -249,70 +490,62 @@ func (srv *tcpServer) closeLoops() {
 func (srv *udpServer) closeLoops() {
 	for _, loop := range srv.loopGroup {
 		if err := loop.poller.Close(); err != nil {
-			srv.logger.Printf("closeLoops idx = %d error : %s\n", loop.idx, err.Error())
+			srv.logger.Error("failed to close event-loop poller", "loop", loop.idx, "error", err)
 		}
 	}
 }
 
 func (srv *tcpServer) signalShutdown() {
 	srv.once.Do(func() {
-		srv.cond.L.Lock()
-		srv.cond.Signal()
-		srv.cond.L.Unlock()
+		close(srv.shutdown)
 	})
 }
-func (srv *tcpServer) waitForShutdown() {
-	srv.cond.L.Lock()
-	srv.cond.Wait()
-	srv.cond.L.Unlock()
-}
+
 func (srv *udpServer) signalShutdown() {
 	srv.once.Do(func() {
-		srv.cond.L.Lock()
-		srv.cond.Signal()
-		srv.cond.L.Unlock()
+		close(srv.shutdown)
 	})
 }
-func (srv *udpServer) waitForShutdown() {
-	srv.cond.L.Lock()
-	srv.cond.Wait()
-	srv.cond.L.Unlock()
-}
 
-func startTcpService(callback IEventCallback, ln *tcpListener, opt *TcpOption) error {
+func startTcpService(callback TcpEventHandler, lns []*tcpListener, opt *TcpOption) (*tcpServer, error) {
 	var (
-		srv tcpServer
+		srv = new(tcpServer)
 		err error
 	)
 	if opt.MultiCore == 0 {
 		opt.MultiCore = runtime.NumCPU()
 	}
 	srv.opt = opt
-	srv.ln = ln
-	srv.localAddr = ln.ln.Addr().String()
-	srv.network = "tcp"
+	srv.lns = lns
+	srv.localAddr = lns[0].addr
+	srv.network = lns[0].network
 	srv.eventHandler = callback
-	srv.cond = sync.NewCond(&sync.Mutex{})
-	srv.subLoopGroup = new(roundRobinEventLoopGroup)
-	srv.logger = func() Logger {
-		if opt.Logger == nil {
-			return defaultLogger
-		}
-		return opt.Logger
-	}()
+	srv.shutdown = make(chan struct{})
+	srv.done = make(chan struct{})
+	srv.subLoopGroup = newEventLoopGroup(srv.opt)
+	srv.logger = loggerOf(opt.Logger)
+	srv.limiter = newAcceptLimiter(opt)
+	srv.workers = srv.newWorkerPool()
 
 	if err = srv.start(opt.MultiCore); err != nil {
-		srv.closeLoops()
-		srv.logger.Printf("service is stop with error : %v\n", err)
-		return err
+		srv.signalShutdown()
+		srv.stop()
+		srv.logger.Error("failed to start service", "network", srv.network, "addr", srv.localAddr, "error", err)
+		return nil, err
 	}
-	defer srv.wait()
-	return nil
+	// 先启动serve，OnInitComplete中可以调用Shutdown
+	go srv.serve()
+	if srv.eventHandler.OnInitComplete(srv) == Shutdown {
+		srv.signalShutdown()
+	}
+	notifyReady()
+	sdNotify(opt.SystemdNotify, srv.logger, "READY=1")
+	return srv, nil
 }
 
-func startUpdService(callback IEventCallback, ln *udpListener, opt *UdpOption) error {
+func startUpdService(callback UdpEventHandler, ln *udpListener, opt *UdpOption) (*udpServer, error) {
 	var (
-		srv udpServer
+		srv = new(udpServer)
 		err error
 	)
 	if opt.MultiCore == 0 {
@@ -320,28 +553,45 @@ func startUpdService(callback IEventCallback, ln *udpListener, opt *UdpOption) e
 	}
 	srv.opt = opt
 	srv.ln = ln
-	srv.network = "udp"
+	srv.network = ln.ln.LocalAddr().Network()
 	srv.localAddr = ln.ln.LocalAddr().String()
 	srv.eventHandler = callback
-	srv.cond = sync.NewCond(&sync.Mutex{})
-	srv.logger = func() Logger {
-		if opt.Logger == nil {
-			return defaultLogger
-		}
-		return opt.Logger
-	}()
+	srv.shutdown = make(chan struct{})
+	srv.done = make(chan struct{})
+	srv.logger = loggerOf(opt.Logger)
 	if err = srv.initLoops(opt.MultiCore); err != nil {
-		srv.closeLoops()
-		srv.logger.Printf("service is stop with error : %v\n", err)
-		return err
+		srv.signalShutdown()
+		srv.stop()
+		srv.logger.Error("failed to start service", "network", srv.network, "addr", srv.localAddr, "error", err)
+		return nil, err
 	}
-	defer srv.stop()
-	return nil
+	// 先启动serve，OnInitComplete中可以调用Shutdown
+	go srv.serve()
+	if srv.eventHandler.OnInitComplete(srv) == Shutdown {
+		srv.signalShutdown()
+	}
+	notifyReady()
+	sdNotify(opt.SystemdNotify, srv.logger, "READY=1")
+	return srv, nil
 }
 
-func (srv *tcpServer) signalHandler() {
-	control := make(chan os.Signal)
-	signal.Notify(control, os.Interrupt, os.Kill)
-	<-control
-	srv.signalShutdown()
+// serve 阻塞直至服务关闭，收到中断信号时优雅关闭服务
+func serve(srv Server) {
+	var (
+		control = make(chan os.Signal, 1)
+		done    = make(chan struct{})
+	)
+	signal.Notify(control, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		select {
+		case <-control:
+			ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+			_ = srv.Shutdown(ctx)
+			cancel()
+		case <-done:
+		}
+	}()
+	srv.Wait()
+	signal.Stop(control)
+	close(done)
 }
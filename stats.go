@@ -0,0 +1,180 @@
+package cnet
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/cuckooemm/cnet/internal/buf"
+	"github.com/cuckooemm/cnet/internal/netpoll"
+	"net/http"
+	"sync/atomic"
+)
+
+// Stats 服务运行状态快照
+type Stats struct {
+	Network   string
+	LocalAddr string
+	// 所有event-loop的合计
+	Connections             int64
+	Accepted, Closed        uint64
+	BytesRead, BytesWritten uint64
+	Loops                   []LoopStats
+	// 等待worker执行的ConnHandler数量，未设置WorkerPool时为0
+	WorkerQueue int
+	// 连接收发缓冲区的缓冲池
+	BufferPool BufferPoolStats
+}
+
+// LoopStats 单个event-loop的状态
+type LoopStats struct {
+	Idx int
+	// 当前连接数
+	Connections int64
+	// 累计打开与关闭的连接数
+	Accepted, Closed uint64
+	// 累计读取与写出的字节数，TLS连接为密文长度
+	BytesRead, BytesWritten uint64
+	// epoll_wait返回的次数
+	Wakeups uint64
+	// 等待执行的异步任务数量
+	AsyncTasks int
+}
+
+type BufferPoolStats struct {
+	// 新建缓冲区的大小与放回池中的缓冲区大小上限
+	DefaultSize, MaxSize int
+	// 取出、放回与新建缓冲区的次数
+	Gets, Puts, Allocs uint64
+}
+
+// loopStats event-loop计数，在event-loop中更新，Stats中原子读取
+type loopStats struct {
+	connections      int64
+	accepted, closed uint64
+	read, written    uint64
+}
+
+func (s *loopStats) snapshot(idx int, poller *netpoll.Poller) LoopStats {
+	return LoopStats{
+		Idx:          idx,
+		Connections:  atomic.LoadInt64(&s.connections),
+		Accepted:     atomic.LoadUint64(&s.accepted),
+		Closed:       atomic.LoadUint64(&s.closed),
+		BytesRead:    atomic.LoadUint64(&s.read),
+		BytesWritten: atomic.LoadUint64(&s.written),
+		Wakeups:      poller.Wakeups(),
+		AsyncTasks:   poller.AsyncTasks(),
+	}
+}
+
+func (s *loopStats) opened() {
+	atomic.AddInt64(&s.connections, 1)
+	atomic.AddUint64(&s.accepted, 1)
+}
+
+func (s *loopStats) closedConn() {
+	atomic.AddInt64(&s.connections, -1)
+	atomic.AddUint64(&s.closed, 1)
+}
+
+func (s *loopStats) addRead(n int) {
+	atomic.AddUint64(&s.read, uint64(n))
+}
+
+func (s *loopStats) addWritten(n int) {
+	if n > 0 {
+		atomic.AddUint64(&s.written, uint64(n))
+	}
+}
+
+func newStats(network, addr string, loops []LoopStats) Stats {
+	var (
+		stats = Stats{Network: network, LocalAddr: addr, Loops: loops}
+		pool  = buf.PoolStats()
+	)
+	for _, l := range loops {
+		stats.Connections += l.Connections
+		stats.Accepted += l.Accepted
+		stats.Closed += l.Closed
+		stats.BytesRead += l.BytesRead
+		stats.BytesWritten += l.BytesWritten
+	}
+	stats.BufferPool = BufferPoolStats{
+		DefaultSize: pool.DefaultSize,
+		MaxSize:     pool.MaxSize,
+		Gets:        pool.Gets,
+		Puts:        pool.Puts,
+		Allocs:      pool.Allocs,
+	}
+	return stats
+}
+
+func (srv *tcpServer) Stats() Stats {
+	var loops []LoopStats
+	srv.subLoopGroup.iterate(func(el *eventTcpLoop) bool {
+		loops = append(loops, el.stats.snapshot(el.idx, el.poller))
+		return true
+	})
+	var stats = newStats(srv.network, srv.localAddr, loops)
+	if srv.workers != nil {
+		stats.WorkerQueue = srv.workers.Len()
+	}
+	return stats
+}
+
+func (srv *udpServer) Stats() Stats {
+	var loops = make([]LoopStats, 0, len(srv.loopGroup))
+	for _, el := range srv.loopGroup {
+		loops = append(loops, el.stats.snapshot(el.idx, el.poller))
+	}
+	return newStats(srv.network, srv.localAddr, loops)
+}
+
+// StatsHandler 以Prometheus文本格式输出服务状态
+func StatsHandler(srv Server) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		var bw = bufio.NewWriter(w)
+		writeMetrics(bw, srv.Stats())
+		_ = bw.Flush()
+	})
+}
+
+func writeMetrics(w *bufio.Writer, stats Stats) {
+	var (
+		server = fmt.Sprintf("network=%q,addr=%q", stats.Network, stats.LocalAddr)
+		header = func(name, typ, help string) {
+			fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+		}
+		loopMetric = func(name, typ, help string, value func(l LoopStats) interface{}) {
+			header(name, typ, help)
+			for _, l := range stats.Loops {
+				fmt.Fprintf(w, "%s{%s,loop=\"%d\"} %v\n", name, server, l.Idx, value(l))
+			}
+		}
+		poolMetric = func(name, typ, help string, value interface{}) {
+			header(name, typ, help)
+			fmt.Fprintf(w, "%s %v\n", name, value)
+		}
+	)
+	loopMetric("cnet_connections", "gauge", "Current number of connections.",
+		func(l LoopStats) interface{} { return l.Connections })
+	loopMetric("cnet_connections_accepted_total", "counter", "Total number of opened connections.",
+		func(l LoopStats) interface{} { return l.Accepted })
+	loopMetric("cnet_connections_closed_total", "counter", "Total number of closed connections.",
+		func(l LoopStats) interface{} { return l.Closed })
+	loopMetric("cnet_read_bytes_total", "counter", "Total number of bytes read.",
+		func(l LoopStats) interface{} { return l.BytesRead })
+	loopMetric("cnet_written_bytes_total", "counter", "Total number of bytes written.",
+		func(l LoopStats) interface{} { return l.BytesWritten })
+	loopMetric("cnet_epoll_wakeups_total", "counter", "Total number of epoll_wait returns.",
+		func(l LoopStats) interface{} { return l.Wakeups })
+	loopMetric("cnet_async_tasks", "gauge", "Number of async tasks waiting to be executed.",
+		func(l LoopStats) interface{} { return l.AsyncTasks })
+	header("cnet_worker_queue", "gauge", "Number of handlers waiting for a free worker.")
+	fmt.Fprintf(w, "cnet_worker_queue{%s} %d\n", server, stats.WorkerQueue)
+	poolMetric("cnet_buffer_pool_default_size_bytes", "gauge", "Size of newly allocated ring buffers.", stats.BufferPool.DefaultSize)
+	poolMetric("cnet_buffer_pool_max_size_bytes", "gauge", "Max size of ring buffers kept in the pool.", stats.BufferPool.MaxSize)
+	poolMetric("cnet_buffer_pool_gets_total", "counter", "Total number of ring buffers taken from the pool.", stats.BufferPool.Gets)
+	poolMetric("cnet_buffer_pool_puts_total", "counter", "Total number of ring buffers returned to the pool.", stats.BufferPool.Puts)
+	poolMetric("cnet_buffer_pool_allocs_total", "counter", "Total number of ring buffers allocated.", stats.BufferPool.Allocs)
+}
@@ -0,0 +1,97 @@
+package cnet
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+const (
+	// systemd socket activation传递的第一个fd
+	sdListenFdsStart = 3
+	// 未设置FileDescriptorName时的socket名称
+	sdUnknownName = "unknown"
+)
+
+var activated struct {
+	once  sync.Once
+	mu    sync.Mutex
+	files map[string][]*os.File // LISTEN_FDNAMES -> fds
+}
+
+// loadActivated 解析systemd传递的socket，LISTEN_PID不是当前进程时忽略，解析后清除环境变量
+func loadActivated() {
+	activated.once.Do(func() {
+		var (
+			pid, errPid = strconv.Atoi(os.Getenv("LISTEN_PID"))
+			n, errN     = strconv.Atoi(os.Getenv("LISTEN_FDS"))
+			names       = strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+		)
+		_ = os.Unsetenv("LISTEN_PID")
+		_ = os.Unsetenv("LISTEN_FDS")
+		_ = os.Unsetenv("LISTEN_FDNAMES")
+		if errPid != nil || errN != nil || pid != os.Getpid() || n <= 0 {
+			return
+		}
+		activated.files = make(map[string][]*os.File, n)
+		for i := 0; i < n; i++ {
+			var (
+				fd   = sdListenFdsStart + i
+				name = sdUnknownName
+			)
+			if i < len(names) && names[i] != "" {
+				name = names[i]
+			}
+			syscall.CloseOnExec(fd)
+			activated.files[name] = append(activated.files[name], os.NewFile(uintptr(fd), name))
+		}
+	})
+}
+
+// takeActivated 返回systemd传递的名为name的socket，同名的socket依次返回，没有时返回nil
+func takeActivated(name string) *os.File {
+	if name == "" {
+		return nil
+	}
+	loadActivated()
+	activated.mu.Lock()
+	defer activated.mu.Unlock()
+	var files = activated.files[name]
+	if len(files) == 0 {
+		return nil
+	}
+	activated.files[name] = files[1:]
+	return files[0]
+}
+
+// SdNotify 向NOTIFY_SOCKET发送状态，如READY=1，未设置NOTIFY_SOCKET时不做处理
+func SdNotify(state string) error {
+	var path = os.Getenv("NOTIFY_SOCKET")
+	if path == "" {
+		return nil
+	}
+	// 抽象socket
+	if path[0] == '@' {
+		path = "\x00" + path[1:]
+	}
+	var c, err = net.DialUnix("unixgram", nil, &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	_, err = c.Write([]byte(state))
+	return err
+}
+
+// sdNotify enabled时通知systemd，失败时记录日志
+func sdNotify(enabled bool, logger Logger, state string) {
+	if !enabled {
+		return
+	}
+	if err := SdNotify(state); err != nil {
+		logger.Warn("failed to notify systemd", "state", state, "error", err)
+	}
+}
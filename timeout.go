@@ -0,0 +1,107 @@
+package cnet
+
+import (
+	"github.com/cuckooemm/cnet/internal/timer"
+	"time"
+)
+
+const (
+	wheelSlots   = 512
+	minWheelTick = 10 * time.Millisecond
+	maxWheelTick = time.Second
+)
+
+// 根据配置的超时时间创建时间轮，未配置超时返回nil
+func newTimeoutWheel(opt *TcpOption) *timer.Wheel {
+	var d = minTimeout(opt)
+	if d <= 0 {
+		return nil
+	}
+	// 时间轮精度为最小超时时间的1/10
+	var tick = d / 10
+	if tick < minWheelTick {
+		tick = minWheelTick
+	} else if tick > maxWheelTick {
+		tick = maxWheelTick
+	}
+	return timer.NewWheel(tick, wheelSlots)
+}
+
+func minTimeout(opt *TcpOption) (d time.Duration) {
+	for _, t := range []time.Duration{opt.IdleTimeout, opt.ReadTimeout, opt.WriteTimeout} {
+		if t > 0 && (d == 0 || t < d) {
+			d = t
+		}
+	}
+	return
+}
+
+func (el *eventTcpLoop) startTimer(c *conn) {
+	if el.wheel == nil || c.timer != nil {
+		return
+	}
+	var d, _ = c.nextTimeout(time.Now(), el.srv.opt)
+	c.timer = el.wheel.AfterFunc(d, func() error {
+		return el.loopTimeout(c)
+	})
+}
+
+func (el *eventTcpLoop) stopTimer(c *conn) {
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+	if c.dialTimer != nil {
+		el.timers.Remove(c.dialTimer)
+		c.dialTimer = nil
+	}
+	if c.proxyTimer != nil {
+		el.timers.Remove(c.proxyTimer)
+		c.proxyTimer = nil
+	}
+	for t := range c.tasks {
+		el.timers.Remove(t.entry)
+	}
+	c.tasks = nil
+}
+
+// 定时器到期，连接已超时则关闭，否则等待下一次检查
+func (el *eventTcpLoop) loopTimeout(c *conn) error {
+	defer el.recoverConn(c)
+	var d, err = c.nextTimeout(time.Now(), el.srv.opt)
+	if err != nil {
+		return el.loopCloseConn(c, err)
+	}
+	c.timer.Reset(d)
+	return nil
+}
+
+// nextTimeout 返回距最近一个超时的时间，已超时返回对应的错误
+func (c *conn) nextTimeout(now time.Time, opt *TcpOption) (next time.Duration, err error) {
+	var check = func(last time.Time, timeout time.Duration, timeoutErr error) {
+		if err != nil || timeout <= 0 {
+			return
+		}
+		var d = timeout - now.Sub(last)
+		if d <= 0 {
+			err = timeoutErr
+			return
+		}
+		if next == 0 || d < next {
+			next = d
+		}
+	}
+	var last = c.lastRead
+	if c.lastWrite.After(last) {
+		last = c.lastWrite
+	}
+	check(last, opt.IdleTimeout, ErrIdleTimeout)
+	check(c.lastRead, opt.ReadTimeout, ErrReadTimeout)
+	if !c.outBuf.IsEmpty() {
+		check(c.lastWrite, opt.WriteTimeout, ErrWriteTimeout)
+	}
+	if next == 0 {
+		next = minTimeout(opt)
+	}
+	return
+}
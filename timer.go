@@ -0,0 +1,114 @@
+package cnet
+
+import (
+	"github.com/cuckooemm/cnet/internal/timer"
+	"runtime/debug"
+	"time"
+)
+
+// 第一次OnTick panic时重新回调的间隔
+const tickRetryInterval = time.Second
+
+type connTimer struct {
+	c      *conn
+	entry  *timer.Entry
+	period time.Duration
+	fn     func(c Conn) (out []byte, op Operation)
+}
+
+// Timeout 实现netpoll.Timer，取定时任务与超时时间轮中最近的一个
+func (el *eventTcpLoop) Timeout() int {
+	var (
+		now = time.Now()
+		ms  = el.timers.Timeout(now)
+	)
+	if el.wheel != nil {
+		if w := el.wheel.Timeout(now); w >= 0 && (ms < 0 || w < ms) {
+			ms = w
+		}
+	}
+	return ms
+}
+
+// Expire 实现netpoll.Timer
+func (el *eventTcpLoop) Expire() error {
+	// OnTick等不属于连接的定时任务，剩余的到期任务在下一轮执行
+	defer el.recoverConn(nil)
+	var now = time.Now()
+	if el.wheel != nil {
+		if err := el.wheel.Advance(now); err != nil {
+			return err
+		}
+	}
+	return el.timers.Expire(now)
+}
+
+func (el *eventTcpLoop) afterFunc(c *conn, d, period time.Duration, fn func(c Conn) ([]byte, Operation)) Timer {
+	var t = &connTimer{c: c, period: period, fn: fn}
+	t.entry = el.timers.AfterFunc(d, t.fire)
+	if c.tasks == nil {
+		c.tasks = make(map[*connTimer]struct{})
+	}
+	c.tasks[t] = struct{}{}
+	return t
+}
+
+func (el *eventTcpLoop) loopTick(t ITicker) error {
+	// OnTick panic时按上一次返回的delay继续回调
+	defer func() {
+		if v := recover(); v != nil {
+			el.handlePanic(nil, v, debug.Stack())
+			if el.tickDelay <= 0 {
+				el.tickDelay = tickRetryInterval
+			}
+			el.timers.Reset(el.tick, el.tickDelay)
+		}
+	}()
+	var delay, op = t.OnTick()
+	if op == Shutdown {
+		return ErrServerShutdown
+	}
+	if el.tickDelay = delay; delay > 0 {
+		el.timers.Reset(el.tick, delay)
+	}
+	return nil
+}
+
+func (t *connTimer) fire() error {
+	var (
+		c   = t.c
+		out []byte
+		op  Operation
+		err error
+	)
+	defer c.loop.recoverConn(c)
+	if c.working {
+		c.deferred = append(c.deferred, t.fireDeferred)
+		return nil
+	}
+	if t.period > 0 {
+		c.loop.timers.Reset(t.entry, t.period)
+	} else {
+		delete(c.tasks, t)
+	}
+	if out, op = t.fn(c); out != nil {
+		if err = c.output(out); err != nil {
+			return c.loop.loopCloseConn(c, err)
+		}
+	}
+	return c.loop.handleOperation(c, op)
+}
+
+// fireDeferred ConnHandler返回后执行推迟的定时任务，期间已Stop或连接已关闭时忽略
+func (t *connTimer) fireDeferred() error {
+	var c = t.c
+	if _, ok := c.tasks[t]; !ok || c.loop.connections[c.fd] != c {
+		return nil
+	}
+	return t.fire()
+}
+
+func (t *connTimer) Stop() {
+	t.c.loop.timers.Remove(t.entry)
+	delete(t.c.tasks, t)
+}
@@ -0,0 +1,259 @@
+package cnet
+
+import (
+	"bytes"
+	"crypto/tls"
+	"github.com/cuckooemm/cnet/internal/buf"
+	"golang.org/x/sys/unix"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// 握手完成后pipe中没有密文时返回，tls.Conn不会将临时错误记录为连接错误
+var errTLSWouldBlock net.Error = wouldBlockError{}
+
+type wouldBlockError struct{}
+
+func (wouldBlockError) Error() string   { return "tls: no more data to read" }
+func (wouldBlockError) Timeout() bool   { return true }
+func (wouldBlockError) Temporary() bool { return true }
+
+// tlsPipe 连接tls.Conn与event-loop的内存net.Conn
+// 握手在独立goroutine中进行，Read阻塞等待event-loop送入的密文，Write通过notify通知event-loop发送
+// 握手完成后所有操作都在event-loop中进行，Read无数据时返回errTLSWouldBlock
+type tlsPipe struct {
+	mu            sync.Mutex
+	cond          *sync.Cond
+	in, out       bytes.Buffer
+	blocking      bool
+	closed        bool
+	notify        func()
+	local, remote net.Addr
+}
+
+func newTLSPipe(local, remote net.Addr, notify func()) *tlsPipe {
+	var p = &tlsPipe{blocking: true, notify: notify, local: local, remote: remote}
+	p.cond = sync.NewCond(&p.mu)
+	return p
+}
+
+func (p *tlsPipe) Read(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for p.in.Len() == 0 {
+		if p.closed {
+			return 0, io.EOF
+		}
+		if !p.blocking {
+			return 0, errTLSWouldBlock
+		}
+		p.cond.Wait()
+	}
+	return p.in.Read(b)
+}
+
+func (p *tlsPipe) Write(b []byte) (int, error) {
+	p.mu.Lock()
+	var notify = p.blocking && !p.closed
+	p.out.Write(b)
+	p.mu.Unlock()
+	if notify {
+		p.notify()
+	}
+	return len(b), nil
+}
+
+// feed 送入从socket读取的密文
+func (p *tlsPipe) feed(b []byte) {
+	if len(b) == 0 {
+		return
+	}
+	p.mu.Lock()
+	p.in.Write(b)
+	p.mu.Unlock()
+	p.cond.Signal()
+}
+
+// take 取出待发送的密文
+func (p *tlsPipe) take() []byte {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.out.Len() == 0 {
+		return nil
+	}
+	var b = make([]byte, p.out.Len())
+	copy(b, p.out.Bytes())
+	p.out.Reset()
+	return b
+}
+
+func (p *tlsPipe) setBlocking(blocking bool) {
+	p.mu.Lock()
+	p.blocking = blocking
+	p.mu.Unlock()
+}
+
+func (p *tlsPipe) Close() error {
+	p.mu.Lock()
+	p.closed = true
+	p.mu.Unlock()
+	p.cond.Broadcast()
+	return nil
+}
+
+func (p *tlsPipe) LocalAddr() net.Addr                { return p.local }
+func (p *tlsPipe) RemoteAddr() net.Addr               { return p.remote }
+func (p *tlsPipe) SetDeadline(_ time.Time) error      { return nil }
+func (p *tlsPipe) SetReadDeadline(_ time.Time) error  { return nil }
+func (p *tlsPipe) SetWriteDeadline(_ time.Time) error { return nil }
+
+// tlsAddr 连接地址，PROXY头会覆盖连接的真实地址
+type tlsAddr struct {
+	network, addr string
+}
+
+func (a tlsAddr) Network() string { return a.network }
+func (a tlsAddr) String() string  { return a.addr }
+
+type tlsConn struct {
+	conn  *tls.Conn
+	pipe  *tlsPipe
+	state *tls.ConnectionState // set after handshake
+}
+
+func newTLSConn(c *conn, config *tls.Config) *tlsConn {
+	var (
+		el            = c.loop
+		local, remote = tlsAddr{c.network, c.localAddr}, tlsAddr{c.network, c.remoteAddr}
+	)
+	var pipe = newTLSPipe(local, remote, func() {
+		_ = c.trigger(func() error {
+			el.loopFlushTLS(c)
+			return nil
+		})
+	})
+	return &tlsConn{conn: tls.Server(pipe, config), pipe: pipe}
+}
+
+// encrypt 加密待发送的数据
+func (t *tlsConn) encrypt(bufs ...[]byte) ([]byte, error) {
+	for _, b := range bufs {
+		if _, err := t.conn.Write(b); err != nil {
+			return nil, err
+		}
+	}
+	return t.pipe.take(), nil
+}
+
+// decrypt 解密pipe中所有完整的record写入inBuf，返回解密的字节数，对端发送close_notify时返回io.EOF
+func (t *tlsConn) decrypt(inBuf *buf.RingBuffer, buffer []byte) (size int, err error) {
+	var n int
+	for {
+		n, err = t.conn.Read(buffer)
+		if n > 0 {
+			inBuf.Write(buffer[:n])
+			size += n
+		}
+		if err != nil {
+			if err == errTLSWouldBlock {
+				err = nil
+			}
+			return
+		}
+	}
+}
+
+// 在独立goroutine中握手，完成后回到event-loop打开连接
+// crypto/tls只提供基于net.Conn的阻塞式Handshake，没有可在数据不足时返回并稍后继续的握手状态机，
+// 因此每个握手中的连接占用一个阻塞在tlsPipe上的goroutine，N个并发握手即N个goroutine。
+// goroutine在握手完成或连接关闭(包括超时关闭)时退出，之后record的加解密都在event-loop中进行
+func (el *eventTcpLoop) startHandshake(c *conn) {
+	var t = c.tls
+	go func() {
+		var err = t.conn.Handshake()
+		_ = c.trigger(func() error {
+			return el.loopHandshaked(c, err)
+		})
+	}()
+}
+
+func (el *eventTcpLoop) loopHandshaked(c *conn, err error) error {
+	// 握手期间连接已关闭
+	if el.connections[c.fd] != c {
+		return nil
+	}
+	el.loopFlushTLS(c)
+	if err != nil {
+		return el.loopCloseConn(c, err)
+	}
+	// 发送握手数据出错时连接已被关闭
+	if el.connections[c.fd] != c {
+		return nil
+	}
+	c.tls.pipe.setBlocking(false)
+	var state = c.tls.conn.ConnectionState()
+	c.tls.state = &state
+	if err = el.loopOpen(c); err != nil || !c.opened {
+		return err
+	}
+	// 处理握手期间已收到的应用数据
+	return el.loopReadTLS(c, nil)
+}
+
+// 发送握手期间产生的密文
+func (el *eventTcpLoop) loopFlushTLS(c *conn) {
+	if el.connections[c.fd] != c {
+		return
+	}
+	if out := c.tls.pipe.take(); out != nil {
+		c.send(out)
+	}
+}
+
+func (el *eventTcpLoop) loopReadTLS(c *conn, data []byte) error {
+	c.tls.pipe.feed(data)
+	// 握手进行中
+	if c.tls.state == nil {
+		return nil
+	}
+	var n, err = c.tls.decrypt(c.inBuf, el.buffer)
+	// 处理KeyUpdate等消息时产生的密文
+	if out := c.tls.pipe.take(); out != nil {
+		c.send(out)
+	}
+	if n > 0 {
+		if e := el.loopHandle(c); e != nil || !c.opened {
+			return e
+		}
+	}
+	if err != nil {
+		// 对端发送close_notify
+		if err == io.EOF {
+			err = nil
+		}
+		return el.loopCloseConn(c, err)
+	}
+	return nil
+}
+
+// 关闭连接前发送close_notify，并结束可能仍在等待数据的握手goroutine
+func (el *eventTcpLoop) closeTLS(c *conn) {
+	if c.tls.state != nil && c.outBuf.IsEmpty() {
+		if err := c.tls.conn.CloseWrite(); err == nil {
+			if out := c.tls.pipe.take(); out != nil {
+				_, _ = unix.Write(c.fd, out)
+			}
+		}
+	}
+	_ = c.tls.pipe.Close()
+}
+
+func (c *conn) TLSState() *tls.ConnectionState {
+	if c.tls == nil || c.tls.state == nil {
+		return nil
+	}
+	var state = *c.tls.state
+	return &state
+}
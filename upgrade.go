@@ -0,0 +1,210 @@
+package cnet
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+const (
+	// 继承的监听，json数组，第i个监听的fd为3+i
+	envInheritFds = "CNET_INHERIT_FDS"
+	// 就绪通知pipe的fd，新进程全部继承的监听启动服务后写入一个字节
+	envUpgradeReady = "CNET_UPGRADE_READY"
+	// 标准输入、输出、错误之后的第一个fd
+	inheritFdStart = 3
+)
+
+type inheritedFile struct {
+	Network string `json:"network"`
+	Addr    string `json:"addr"`
+	f       *os.File
+}
+
+var inherited struct {
+	once  sync.Once
+	mu    sync.Mutex
+	files []*inheritedFile
+	ready *os.File
+}
+
+// upgradeCommand 新进程的可执行文件与参数
+var upgradeCommand = func() (string, []string, error) {
+	var path, err = os.Executable()
+	return path, os.Args, err
+}
+
+// loadInherited 解析父进程传递的监听fd，解析后清除环境变量，避免传递给之后启动的子进程
+func loadInherited() {
+	inherited.once.Do(func() {
+		var meta, ready = os.Getenv(envInheritFds), os.Getenv(envUpgradeReady)
+		_ = os.Unsetenv(envInheritFds)
+		_ = os.Unsetenv(envUpgradeReady)
+		if meta != "" && json.Unmarshal([]byte(meta), &inherited.files) == nil {
+			for i, file := range inherited.files {
+				syscall.CloseOnExec(inheritFdStart + i)
+				file.f = os.NewFile(uintptr(inheritFdStart+i), file.Network+":"+file.Addr)
+			}
+		}
+		if fd, err := strconv.Atoi(ready); err == nil {
+			syscall.CloseOnExec(fd)
+			inherited.ready = os.NewFile(uintptr(fd), "upgrade-ready")
+		}
+	})
+}
+
+// takeInherited 返回父进程传递的network与addr均相同的监听，没有时返回nil
+func takeInherited(network, addr string) *os.File {
+	loadInherited()
+	inherited.mu.Lock()
+	defer inherited.mu.Unlock()
+	for i, file := range inherited.files {
+		if file.Network == network && file.Addr == addr {
+			inherited.files = append(inherited.files[:i], inherited.files[i+1:]...)
+			return file.f
+		}
+	}
+	return nil
+}
+
+// notifyReady 全部继承的监听都已启动服务时通知父进程
+func notifyReady() {
+	loadInherited()
+	inherited.mu.Lock()
+	defer inherited.mu.Unlock()
+	if inherited.ready == nil || len(inherited.files) > 0 {
+		return
+	}
+	_, _ = inherited.ready.Write([]byte{1})
+	_ = inherited.ready.Close()
+	inherited.ready = nil
+}
+
+// Upgrade 启动新进程并传递监听，新进程就绪后优雅关闭服务
+func (srv *tcpServer) Upgrade(ctx context.Context) error {
+	var (
+		files = make([]*inheritedFile, 0, len(srv.lns))
+		fds   = make([]int, 0, len(srv.lns))
+	)
+	for _, ln := range srv.lns {
+		files = append(files, &inheritedFile{Network: ln.network, Addr: ln.bind})
+		fds = append(fds, ln.fd)
+	}
+	var pid, err = startUpgrade(ctx, files, fds)
+	if err != nil {
+		srv.logger.Error("failed to upgrade", "addr", srv.localAddr, "error", err)
+		return err
+	}
+	srv.logger.Info("upgraded, shutting down", "addr", srv.localAddr, "pid", pid)
+	// 由新进程作为systemd服务的主进程
+	sdNotify(srv.opt.SystemdNotify, srv.logger, "MAINPID="+strconv.Itoa(pid))
+	for _, ln := range srv.lns {
+		ln.handoff()
+	}
+	return srv.Shutdown(ctx)
+}
+
+// Upgrade 启动新进程并传递监听，新进程就绪后关闭服务
+func (srv *udpServer) Upgrade(ctx context.Context) error {
+	var file = &inheritedFile{Network: srv.network, Addr: srv.ln.bind}
+	var pid, err = startUpgrade(ctx, []*inheritedFile{file}, []int{srv.ln.fd})
+	if err != nil {
+		srv.logger.Error("failed to upgrade", "addr", srv.localAddr, "error", err)
+		return err
+	}
+	srv.logger.Info("upgraded, shutting down", "addr", srv.localAddr, "pid", pid)
+	sdNotify(srv.opt.SystemdNotify, srv.logger, "MAINPID="+strconv.Itoa(pid))
+	srv.ln.handoff()
+	return srv.Shutdown(ctx)
+}
+
+// startUpgrade 以相同的参数启动新进程，fds依次传递为fd 3、4...，等待新进程就绪后返回其pid
+// ctx结束或新进程退出时终止新进程并返回错误
+func startUpgrade(ctx context.Context, files []*inheritedFile, fds []int) (int, error) {
+	var (
+		path string
+		args []string
+		meta []byte
+		r, w *os.File
+		pid  int
+		err  error
+	)
+	if path, args, err = upgradeCommand(); err != nil {
+		return 0, err
+	}
+	if meta, err = json.Marshal(files); err != nil {
+		return 0, err
+	}
+	if r, w, err = os.Pipe(); err != nil {
+		return 0, err
+	}
+	defer r.Close()
+	// 使用ForkExec直接传递fd，os.File.Fd会将与新进程共享的监听设为阻塞模式
+	var procFiles = []uintptr{os.Stdin.Fd(), os.Stdout.Fd(), os.Stderr.Fd()}
+	for _, fd := range fds {
+		procFiles = append(procFiles, uintptr(fd))
+	}
+	procFiles = append(procFiles, w.Fd())
+	pid, err = syscall.ForkExec(path, args, &syscall.ProcAttr{
+		Env: append(upgradeEnv(),
+			envInheritFds+"="+string(meta),
+			envUpgradeReady+"="+strconv.Itoa(inheritFdStart+len(fds))),
+		Files: procFiles,
+	})
+	_ = w.Close()
+	if err != nil {
+		return 0, err
+	}
+	var proc, _ = os.FindProcess(pid)
+	// 回收新进程，避免当前进程未退出时新进程成为僵尸进程
+	go func() { _, _ = proc.Wait() }()
+
+	var ready = make(chan error, 1)
+	go func() {
+		var b [1]byte
+		if _, err := r.Read(b[:]); err != nil {
+			ready <- ErrUpgradeFailed
+			return
+		}
+		ready <- nil
+	}()
+	select {
+	case err = <-ready:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	if err != nil {
+		_ = proc.Kill()
+		return 0, err
+	}
+	return pid, nil
+}
+
+// upgradeEnv 当前进程的环境变量，去除继承相关的变量
+func upgradeEnv() []string {
+	var env = make([]string, 0, len(os.Environ()))
+	for _, kv := range os.Environ() {
+		if strings.HasPrefix(kv, envInheritFds+"=") || strings.HasPrefix(kv, envUpgradeReady+"=") {
+			continue
+		}
+		env = append(env, kv)
+	}
+	return env
+}
+
+// handoff 监听已交给新进程，关闭时不再删除socket文件
+func (ln *tcpListener) handoff() {
+	if l, ok := ln.ln.(*net.UnixListener); ok {
+		l.SetUnlinkOnClose(false)
+	}
+}
+
+// handoff 监听已交给新进程，关闭时不再删除socket文件
+func (ln *udpListener) handoff() {
+	ln.path = ""
+}
@@ -0,0 +1,173 @@
+package cnet
+
+import (
+	"github.com/cuckooemm/cnet/internal/workerpool"
+	"runtime/debug"
+	"sync/atomic"
+)
+
+// 未设置WorkerPool时返回nil
+// worker线程记录为srv的回调线程，其中调用Shutdown与Wait不阻塞
+func (srv *tcpServer) newWorkerPool() *workerpool.Pool {
+	if srv.opt.WorkerPool <= 0 {
+		return nil
+	}
+	var queue = srv.opt.WorkerQueueSize
+	if queue < 0 {
+		queue = 0
+	}
+	return workerpool.New(srv.opt.WorkerPool, queue, func() func() {
+		return enterWorker(srv)
+	})
+}
+
+// loopDispatch 将ConnHandler交给worker执行，执行期间停止读取，inBuf只由worker访问
+// 执行期间连接的关闭、Wake与定时任务推迟到ConnHandler返回后在event-loop中执行
+func (el *eventTcpLoop) loopDispatch(c *conn) error {
+	c.working = true
+	if err := c.updateEvents(); err != nil {
+		c.working = false
+		return el.loopCloseConn(c, err)
+	}
+	// 已有连接在排队时同样排队，保证先到先执行
+	if len(el.waiting) > 0 || !el.submit(c) {
+		el.waiting = append(el.waiting, c)
+		// 标记之后重试一次，避免worker在标记之前空闲而不通知
+		atomic.StoreInt32(&el.queued, 1)
+		return el.loopRetryDispatch()
+	}
+	return nil
+}
+
+func (el *eventTcpLoop) submit(c *conn) bool {
+	return el.srv.workers.TrySubmit(func() func() {
+		var out, op, v, stack = work(c)
+		return func() {
+			if err := c.trigger(func() error {
+				if v != nil {
+					return el.loopWorkPanicked(c, v, stack)
+				}
+				return el.loopWorked(c, out, op)
+			}); err != nil {
+				el.srv.logger.Debug("failed to return worker result", "loop", el.idx, "remote", c.remoteAddr, "error", err)
+			}
+			el.srv.retryWaiting(el)
+		}
+	})
+}
+
+// retryWaiting worker空闲后通知有连接排队的其他event-loop重新提交，from在处理结果时重新提交
+func (srv *tcpServer) retryWaiting(from *eventTcpLoop) {
+	srv.subLoopGroup.iterate(func(el *eventTcpLoop) bool {
+		if el != from && atomic.LoadInt32(&el.queued) != 0 {
+			_ = el.poller.Trigger(el.loopRetryDispatch)
+		}
+		return true
+	})
+}
+
+// work 在worker中执行ConnHandler，panic时返回panic的值与调用栈
+func work(c *conn) (out []byte, op Operation, v interface{}, stack []byte) {
+	defer func() {
+		if v = recover(); v != nil {
+			stack = debug.Stack()
+		}
+	}()
+	out, op = c.handler.ConnHandler(c)
+	return
+}
+
+// finishWork worker执行完成，之后连接的事件与回调在event-loop中直接处理
+func (el *eventTcpLoop) finishWork(c *conn) {
+	c.working = false
+	c.frame = nil
+}
+
+// loopDeferred 按顺序执行ConnHandler执行期间推迟的关闭、Wake与定时任务
+func (el *eventTcpLoop) loopDeferred(c *conn) error {
+	defer el.recoverConn(c)
+	var fns = c.deferred
+	c.deferred = nil
+	for _, fn := range fns {
+		if err := fn(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loopWorkPanicked ConnHandler在worker中panic，关闭连接
+func (el *eventTcpLoop) loopWorkPanicked(c *conn, v interface{}, stack []byte) error {
+	el.finishWork(c)
+	if err := el.loopRetryDispatch(); err != nil {
+		return err
+	}
+	// 执行期间连接已关闭时只执行推迟的关闭
+	if !c.closing {
+		el.handlePanic(c, v, stack)
+	}
+	return el.loopDeferred(c)
+}
+
+// loopWorked 在event-loop中处理worker返回的结果，恢复读取并继续处理已解码的帧
+func (el *eventTcpLoop) loopWorked(c *conn, out []byte, op Operation) error {
+	el.finishWork(c)
+	// worker已空闲，先提交排队的连接
+	if err := el.loopRetryDispatch(); err != nil {
+		return err
+	}
+	// 执行期间连接已关闭，丢弃结果并回调OnConnClosed
+	if c.closing {
+		return el.loopDeferred(c)
+	}
+	if err := c.updateEvents(); err != nil {
+		return el.loopCloseConn(c, err)
+	}
+	if out != nil {
+		if err := c.output(out); err != nil {
+			return el.loopCloseConn(c, err)
+		}
+	}
+	switch op {
+	case Close:
+		return el.loopCloseConn(c, nil)
+	case Shutdown:
+		return ErrServerShutdown
+	}
+	if err := el.loopDeferred(c); err != nil || el.connections[c.fd] != c {
+		return err
+	}
+	if el.srv.opt.Codec != nil && !c.working {
+		return el.loopHandle(c)
+	}
+	return nil
+}
+
+// loopRetryDispatch 依次提交排队的连接，worker池仍满时等待worker返回结果后再提交
+func (el *eventTcpLoop) loopRetryDispatch() error {
+	var (
+		n   int
+		err error
+	)
+	for _, c := range el.waiting {
+		// 排队期间连接已关闭
+		if c.closing {
+			el.finishWork(c)
+			if e := el.loopDeferred(c); e != nil && err == nil {
+				err = e
+			}
+		} else if !el.submit(c) {
+			break
+		}
+		n++
+	}
+	var rest = copy(el.waiting, el.waiting[n:])
+	for i := rest; i < len(el.waiting); i++ {
+		el.waiting[i] = nil
+	}
+	el.waiting = el.waiting[:rest]
+	if len(el.waiting) == 0 {
+		atomic.StoreInt32(&el.queued, 0)
+	}
+	return err
+}